@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/stefansundin/shrimp/flowrate"
+)
+
+// Background mode tries to keep the queueing delay below this target (the same target as LEDBAT, RFC 6817)
+const backgroundTargetDelay = 100 * time.Millisecond
+
+const backgroundProbeInterval = time.Second
+const backgroundMinRate = 10e3
+
+// The rate that background mode starts at if there is no other limit
+const backgroundInitialRate = 1e6
+
+// The baseline round-trip time is the lowest measurement in the last 10 minutes. One minimum is kept per minute so that the baseline can follow route changes.
+const backgroundBaseHistory = 10
+
+// backgroundController adjusts the rate of a bucket based on the latency to the endpoint.
+// The latency is measured by timing TCP connections to the endpoint. When the latency rises above the baseline, the link is assumed to be congested (e.g. by other traffic) and the rate is lowered.
+type backgroundController struct {
+	mu          sync.Mutex
+	host, port  string
+	addr        string // Resolved address, so that DNS lookups are not included in the measurements
+	bucket      *flowrate.Bucket
+	active      bool
+	baseHistory []time.Duration
+	baseStarted time.Time
+	recent      []time.Duration
+	base        time.Duration
+	delay       time.Duration
+	rate        int64
+	probeErr    error
+}
+
+func newBackgroundController(host, port string, bucket *flowrate.Bucket, ceiling int64) *backgroundController {
+	c := &backgroundController{
+		host:   host,
+		port:   port,
+		bucket: bucket,
+		rate:   backgroundInitialRate,
+	}
+	if ceiling != 0 {
+		c.rate = ceiling
+	}
+	bucket.SetRate(c.rate)
+	return c
+}
+
+// setActive marks whether an upload is in progress. The latency is measured all the time, but the rate is only adjusted while uploading.
+func (c *backgroundController) setActive(active bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = active
+}
+
+func (c *backgroundController) probe() (time.Duration, error) {
+	if c.addr == "" {
+		addrs, err := net.LookupHost(c.host)
+		if err != nil {
+			return 0, err
+		}
+		c.addr = net.JoinHostPort(addrs[0], c.port)
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
+	if err != nil {
+		// Resolve the address again next time in case it has changed
+		c.addr = ""
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, nil
+}
+
+// update records a round-trip time measurement and adjusts the rate.
+// ceiling is the upper bound for the rate (0 for unlimited), and throughput is the current transfer rate, which is used to avoid raising the rate when the upload can not use it anyway.
+func (c *backgroundController) update(rtt time.Duration, ceiling, throughput int64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.baseHistory) == 0 || now.Sub(c.baseStarted) >= time.Minute {
+		c.baseHistory = append(c.baseHistory, rtt)
+		if len(c.baseHistory) > backgroundBaseHistory {
+			c.baseHistory = c.baseHistory[1:]
+		}
+		c.baseStarted = now
+	} else if rtt < c.baseHistory[len(c.baseHistory)-1] {
+		c.baseHistory[len(c.baseHistory)-1] = rtt
+	}
+	c.base = c.baseHistory[0]
+	for _, d := range c.baseHistory {
+		if d < c.base {
+			c.base = d
+		}
+	}
+
+	// Use the lowest of the last few measurements to filter out noise
+	c.recent = append(c.recent, rtt)
+	if len(c.recent) > 3 {
+		c.recent = c.recent[1:]
+	}
+	current := c.recent[0]
+	for _, d := range c.recent {
+		if d < current {
+			current = d
+		}
+	}
+	c.delay = current - c.base
+
+	if !c.active {
+		return
+	}
+	offTarget := float64(backgroundTargetDelay-c.delay) / float64(backgroundTargetDelay)
+	rate := float64(c.rate)
+	if offTarget < 0 {
+		// Back off multiplicatively, but by no more than half
+		rate *= math.Max(0.5, 1+offTarget/4)
+	} else if throughput == 0 || rate < 2*float64(throughput) {
+		rate += math.Max(rate*0.1, backgroundMinRate) * offTarget
+	}
+	if ceiling != 0 && rate > float64(ceiling) {
+		rate = float64(ceiling)
+	}
+	if rate < backgroundMinRate {
+		rate = backgroundMinRate
+	}
+	if int64(rate) != c.rate {
+		c.rate = int64(rate)
+		c.bucket.SetRate(c.rate)
+	}
+}
+
+// run measures the latency periodically until ctx is done.
+func (c *backgroundController) run(ctx context.Context, ceiling, throughput func() int64) {
+	ticker := time.NewTicker(backgroundProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rtt, err := c.probe()
+			c.mu.Lock()
+			if err != nil && c.probeErr == nil {
+				fmt.Fprintf(warningOutput(), "\nBackground mode: could not measure the latency: %v\n", err)
+			}
+			c.probeErr = err
+			c.mu.Unlock()
+			if err == nil {
+				c.update(rtt, ceiling(), throughput(), time.Now())
+			}
+		}
+	}
+}
+
+func (c *backgroundController) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.baseHistory) == 0 {
+		return fmt.Sprintf("adaptive limit: %s (no latency measurements yet)", formatLimit2(c.rate))
+	}
+	return fmt.Sprintf("adaptive limit: %s (base latency: %s, queueing delay: %s)", formatLimit2(c.rate), c.base.Round(time.Millisecond), c.delay.Round(time.Millisecond))
+}
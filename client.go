@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// clientOptions are the parameters that affect how the S3 client is set up.
+type clientOptions struct {
+	profile               string
+	region                string
+	endpointURL           string
+	caBundle              string
+	noVerifySsl           bool
+	noSignRequest         bool
+	usePathStyle          bool
+	useAccelerateEndpoint bool
+	mfaDuration           time.Duration
+	mfaSecret             []byte
+	debug                 bool
+}
+
+// mfaPrompt is where the MFA code is read from. Once the terminal has been configured for the keyboard controls, the goroutine that reads stdin forwards the code through a pipe while prompting is true.
+type mfaPrompt struct {
+	prompting bool
+	reader    io.Reader
+}
+
+// newS3Client initializes the AWS SDK and looks up the bucket region (unless it is given or a custom endpoint is used).
+func newS3Client(bucket string, opts clientOptions, mfa *mfaPrompt) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(
+		context.TODO(),
+		func(o *config.LoadOptions) error {
+			if opts.profile != "" {
+				o.SharedConfigProfile = opts.profile
+			}
+			if opts.caBundle != "" {
+				f, err := os.Open(opts.caBundle)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				o.CustomCABundle = f
+			}
+			if opts.noVerifySsl {
+				o.HTTPClient = &http.Client{
+					Transport: &http.Transport{
+						TLSClientConfig: &tls.Config{
+							InsecureSkipVerify: true,
+						},
+					},
+				}
+			}
+			if opts.debug {
+				var lm aws.ClientLogMode = aws.LogRequest | aws.LogResponse
+				o.ClientLogMode = &lm
+			}
+			return nil
+		},
+		config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
+			o.Duration = opts.mfaDuration
+			o.TokenProvider = func() (string, error) {
+				if opts.mfaSecret == nil {
+					mfa.prompting = true
+					for {
+						fmt.Fprint(os.Stderr, "Assume Role MFA token code: ")
+						var code string
+						_, err := fmt.Fscanln(mfa.reader, &code)
+						if len(code) == 6 && isNumeric(code) {
+							mfa.prompting = false
+							return code, err
+						}
+						fmt.Fprintln(os.Stderr, "Code must consist of 6 digits. Please try again.")
+					}
+				} else {
+					t := time.Now().UTC()
+					period := 30
+					counter := uint64(math.Floor(float64(t.Unix()) / float64(period)))
+					code, err := generateOTP(opts.mfaSecret, counter, sha1.New, 6)
+					if opts.debug {
+						fmt.Fprintf(os.Stderr, "Generated TOTP code: %s\n", code)
+					}
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					}
+					return code, err
+				}
+			}
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg,
+		func(o *s3.Options) {
+			o.EndpointOptions.UseDualStackEndpoint = useDualStackEndpoint
+			if opts.noSignRequest {
+				o.Credentials = aws.AnonymousCredentials{}
+			}
+			if opts.region != "" {
+				o.Region = opts.region
+			}
+			if opts.endpointURL != "" {
+				o.BaseEndpoint = aws.String(opts.endpointURL)
+			}
+			if opts.usePathStyle {
+				o.UsePathStyle = true
+			}
+			if opts.useAccelerateEndpoint {
+				o.UseAccelerate = true
+			}
+		})
+
+	// Get the bucket location
+	if opts.endpointURL == "" && opts.region == "" {
+		bucketLocationOutput, err := client.GetBucketLocation(context.TODO(), &s3.GetBucketLocationInput{
+			Bucket: aws.String(bucket),
+		})
+		if err != nil {
+			return nil, err
+		}
+		bucketRegion := normalizeBucketLocation(bucketLocationOutput.LocationConstraint)
+		if opts.debug {
+			fmt.Fprintf(os.Stderr, "Bucket region: %s\n", bucketRegion)
+		}
+		client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+			o.EndpointOptions.UseDualStackEndpoint = useDualStackEndpoint
+			if opts.noSignRequest {
+				o.Credentials = aws.AnonymousCredentials{}
+			}
+			o.Region = bucketRegion
+			if opts.usePathStyle {
+				o.UsePathStyle = true
+			}
+			if opts.useAccelerateEndpoint {
+				o.UseAccelerate = true
+			}
+		})
+	}
+	return client, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression (--compress)
+//
+// Every part is compressed independently as a complete gzip member or zstd frame. Both formats allow members/frames to be concatenated, so the object is a valid gzip or zstd stream. Since the compressed size of a part is not known in advance, the file is fed to the compressor one slice at a time until the compressed part has reached the part size. The compressed part is written to a temporary file, since parts can be several GiB. Where each part starts in the file is recorded in the upload state, so that an interrupted upload can be resumed.
+var compressionFormats = []string{"gzip", "zstd"}
+
+// The amount of the file that is compressed at a time. A part is at most this much (compressed) over the part size.
+const compressionSliceSize = 1 * MiB
+
+// The worst-case compressed size of a slice (data that does not compress grows slightly), including the end of the gzip member or zstd frame
+const maxCompressedSliceSize = compressionSliceSize + compressionSliceSize/16
+
+// The maximum part size on Amazon S3
+const maxPartSize = 5 * GiB
+
+// compressedPart is where a part starts in the file, how much of the file it covers, and its compressed size.
+type compressedPart struct {
+	RawOffset int64 `json:"rawOffset"`
+	RawSize   int64 `json:"rawSize"`
+	Size      int64 `json:"size"`
+}
+
+// compressionState is stored in the upload state.
+type compressionState struct {
+	Format string           `json:"format"`
+	Parts  []compressedPart `json:"parts"`
+}
+
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type compressor struct {
+	format string
+	src    io.ReaderAt
+	size   int64
+	buf    []byte
+	spool  *os.File // The compressed part
+
+	// The last part that was compressed, so that it does not have to be compressed again if the upload of the part is retried
+	cached        bool
+	cachedOffset  int64
+	cachedRawSize int64
+	cachedSize    int64
+}
+
+func newCompressor(format string, src io.ReaderAt, size int64) (*compressor, error) {
+	spool, err := os.CreateTemp("", "shrimp-part-*")
+	if err != nil {
+		return nil, err
+	}
+	// The file can be removed right away on systems other than Windows, so that it is not left behind if shrimp exits without cleaning up
+	if runtime.GOOS != "windows" {
+		os.Remove(spool.Name())
+	}
+	return &compressor{
+		format: format,
+		src:    src,
+		size:   size,
+		buf:    make([]byte, compressionSliceSize),
+		spool:  spool,
+	}, nil
+}
+
+// Close removes the temporary file.
+func (c *compressor) Close() error {
+	c.spool.Close()
+	err := os.Remove(c.spool.Name())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (c *compressor) newWriter(w io.Writer) (compressWriter, error) {
+	switch c.format {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unsupported compression format: %s", c.format)
+}
+
+// compressPart compresses the file from offset until the compressed data is at least target bytes, or until the end of the file. It returns the compressed data, its size and how much of the file it covers.
+func (c *compressor) compressPart(offset, target int64) (io.ReadSeeker, int64, int64, error) {
+	if c.cached && c.cachedOffset == offset {
+		return io.NewSectionReader(c.spool, 0, c.cachedSize), c.cachedSize, c.cachedRawSize, nil
+	}
+	c.cached = false
+	// Stay below the maximum part size even if the last slice does not compress at all
+	target = min(target, maxPartSize-maxCompressedSliceSize)
+
+	err := c.spool.Truncate(0)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	_, err = c.spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	bw := bufio.NewWriterSize(c.spool, compressionSliceSize)
+	out := &countingWriter{w: bw}
+	w, err := c.newWriter(out)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	pos := offset
+	for pos < c.size {
+		n := c.size - pos
+		if n > compressionSliceSize {
+			n = compressionSliceSize
+		}
+		buf := c.buf[:n]
+		m, err := c.src.ReadAt(buf, pos)
+		if err == io.EOF && int64(m) == n {
+			err = nil
+		}
+		if err == io.EOF {
+			return nil, 0, 0, fmt.Errorf("the file is smaller than expected (%d bytes), has it been modified?", c.size)
+		} else if err != nil {
+			return nil, 0, 0, err
+		}
+		_, err = w.Write(buf)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		pos += n
+		err = w.Flush()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if out.n >= target {
+			break
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	c.cached = true
+	c.cachedOffset = offset
+	c.cachedRawSize = pos - offset
+	c.cachedSize = out.n
+	return io.NewSectionReader(c.spool, 0, c.cachedSize), c.cachedSize, c.cachedRawSize, nil
+}
+
+// countingWriter counts the bytes that are written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// estimateCompressedSize estimates the compressed size of the whole file, based on the compression ratio so far.
+func estimateCompressedSize(rawDone, compressedDone, rawSize int64) int64 {
+	if rawDone == 0 {
+		return rawSize
+	}
+	return compressedDone + int64(float64(rawSize-rawDone)*float64(compressedDone)/float64(rawDone))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	flag "github.com/stefansundin/go-zflag"
+)
+
+// Prefix of the environment variables that can be used instead of flags, e.g. SHRIMP_BWLIMIT=2.5m
+const configEnvPrefix = "SHRIMP_"
+
+// Flags that can not be set in the config file or with environment variables
+var configIgnoredFlags = map[string]bool{
+	"config":  true,
+	"version": true,
+}
+
+// Flags that are masked when the configuration or the command to resume the upload is printed
+var configSecretFlags = map[string]bool{
+	"sse-c-key":              true,
+	"client-side-key":        true,
+	"client-side-passphrase": true,
+}
+
+// iniSection is a section in the config file. The keys are kept in the order that they appear in the file.
+type iniSection struct {
+	name   string
+	keys   []string
+	values map[string]string
+}
+
+// iniFile is an INI-style config file:
+//
+//	# Comment
+//	[section]
+//	key = value
+type iniFile struct {
+	sections []*iniSection
+}
+
+func (c *iniFile) section(name string) *iniSection {
+	for _, s := range c.sections {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func defaultConfigFile() (string, error) {
+	configDir, err := defaultConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "config"), nil
+}
+
+// readConfig reads a config file. A missing file results in an empty config.
+func readConfig(fn string) (*iniFile, error) {
+	c := &iniFile{}
+	f, err := os.Open(fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var section *iniSection
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("line %d: invalid section header: %s", lineNumber, line)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			section = c.section(name)
+			if section == nil {
+				section = &iniSection{name: name, values: make(map[string]string)}
+				c.sections = append(c.sections, section)
+			}
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key = value: %s", lineNumber, line)
+		}
+		if section == nil {
+			return nil, fmt.Errorf("line %d: key outside of a section: %s", lineNumber, line)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		// Allow comments at the end of the line
+		if i := strings.Index(value, " #"); i != -1 {
+			value = strings.TrimSpace(value[:i])
+		}
+		if _, exists := section.values[key]; !exists {
+			section.keys = append(section.keys, key)
+		}
+		section.values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configSetting is a flag value from the config file or from an environment variable.
+type configSetting struct {
+	value  string
+	source string
+}
+
+// applyConfig sets the flags that were not given on the command line. The settings are applied in this order, where later ones take precedence:
+//
+//	[default]
+//	[endpoint <url>]  (matches --endpoint-url)
+//	[bucket <name>]   (matches the bucket name, which can be a glob, e.g. [bucket backups-*])
+//	SHRIMP_* environment variables
+//	command-line flags
+//
+// It returns where each flag got its value from.
+func applyConfig(c *iniFile, fn string, bucket string) (map[string]string, error) {
+	settings := make(map[string]configSetting)
+	addSection := func(section *iniSection) error {
+		for _, key := range section.keys {
+			if configIgnoredFlags[key] || flag.Lookup(key) == nil {
+				return fmt.Errorf("[%s] unknown option: %s", section.name, key)
+			}
+			settings[key] = configSetting{section.values[key], fmt.Sprintf("%s [%s]", fn, section.name)}
+		}
+		return nil
+	}
+
+	if section := c.section("default"); section != nil {
+		if err := addSection(section); err != nil {
+			return nil, err
+		}
+	}
+
+	// The endpoint can be set by a bucket section or an environment variable, so look at those first to determine which endpoint section to use
+	var bucketSections []*iniSection
+	for _, section := range c.sections {
+		if pattern, found := strings.CutPrefix(section.name, "bucket "); found {
+			pattern = strings.TrimSpace(pattern)
+			match, err := path.Match(pattern, bucket)
+			if err != nil {
+				return nil, fmt.Errorf("[%s] invalid pattern: %w", section.name, err)
+			}
+			if match {
+				bucketSections = append(bucketSections, section)
+			}
+		}
+	}
+	endpointURL := settings["endpoint-url"].value
+	for _, section := range bucketSections {
+		if v, ok := section.values["endpoint-url"]; ok {
+			endpointURL = v
+		}
+	}
+	if v, ok := os.LookupEnv(configEnvPrefix + "ENDPOINT_URL"); ok {
+		endpointURL = v
+	}
+	if f := flag.Lookup("endpoint-url"); f.Changed {
+		endpointURL = f.Value.String()
+	}
+	if endpointURL != "" {
+		for _, section := range c.sections {
+			if u, found := strings.CutPrefix(section.name, "endpoint "); found && strings.TrimRight(strings.TrimSpace(u), "/") == strings.TrimRight(endpointURL, "/") {
+				if err := addSection(section); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for _, section := range bucketSections {
+		if err := addSection(section); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		key, found := strings.CutPrefix(name, configEnvPrefix)
+		if !found || name == configEnvPrefix+"CONFIG" {
+			continue
+		}
+		key = strings.ReplaceAll(strings.ToLower(key), "_", "-")
+		if configIgnoredFlags[key] || flag.Lookup(key) == nil {
+			fmt.Fprintf(warningOutput(), "Warning: Ignoring unknown environment variable %s.\n", name)
+			continue
+		}
+		settings[key] = configSetting{value, name}
+	}
+
+	// Command-line flags take precedence
+	sources := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "command line"
+	})
+	for key, setting := range settings {
+		if _, set := sources[key]; set {
+			continue
+		}
+		if err := flag.Set(key, setting.value); err != nil {
+			return nil, fmt.Errorf("%s: %w", setting.source, err)
+		}
+		sources[key] = setting.source
+	}
+	return sources, nil
+}
+
+// printConfig prints the flags that have been set and where they came from.
+func printConfig(sources map[string]string) {
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Effective configuration:")
+	for _, name := range names {
+		value := flag.Lookup(name).Value.String()
+		if configSecretFlags[name] && value != "" {
+			value = "********"
+		}
+		fmt.Fprintf(os.Stderr, "  %s = %s (from %s)\n", name, value, sources[name])
+	}
+}
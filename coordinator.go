@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stefansundin/shrimp/flowrate"
+)
+
+// How often the processes check in with each other. Registrations that have not been updated in a while are considered stale (e.g. the process was killed).
+const coordinatorInterval = 2 * time.Second
+const coordinatorStaleAfter = 5 * coordinatorInterval
+
+// hostCoordinator splits a bandwidth limit between all shrimp processes on the host that use --host-bwlimit.
+// Each process writes a registration file to a shared directory and reads the registrations of the other processes to calculate its share.
+// Files are only ever written by the process that owns them (and replaced atomically), so no locking is necessary.
+type hostCoordinator struct {
+	mu     sync.Mutex
+	fn     string
+	limit  int64
+	weight int
+	active bool
+	closed bool
+	bucket *flowrate.Bucket
+
+	// Result of the last rebalance
+	processes   int
+	sharedLimit int64
+	share       int64
+}
+
+type hostRegistration struct {
+	Pid       int       `json:"pid"`
+	Limit     int64     `json:"limit"`
+	Weight    int       `json:"weight"`
+	Active    bool      `json:"active"`
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+func coordinatorDir() string {
+	if dir, ok := os.LookupEnv("XDG_RUNTIME_DIR"); ok && dir != "" {
+		return filepath.Join(dir, "shrimp")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("shrimp-%d", os.Getuid()))
+}
+
+func newHostCoordinator(limit int64, weight int, bucket *flowrate.Bucket) (*hostCoordinator, error) {
+	if weight < 1 {
+		return nil, errors.New("the weight must be at least 1")
+	}
+	dir := coordinatorDir()
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	c := &hostCoordinator{
+		fn:     filepath.Join(dir, fmt.Sprintf("%d.json", os.Getpid())),
+		limit:  limit,
+		weight: weight,
+		bucket: bucket,
+	}
+	return c, c.rebalance()
+}
+
+// setActive marks whether this process is currently uploading. Inactive processes do not get a share of the limit.
+func (c *hostCoordinator) setActive(active bool) {
+	c.mu.Lock()
+	changed := c.active != active
+	c.active = active
+	c.mu.Unlock()
+	if changed {
+		c.rebalance()
+	}
+}
+
+// rebalance updates the registration of this process and recalculates its share of the limit.
+// The smallest limit among the active processes is used, and it is split between them according to their weights.
+func (c *hostCoordinator) rebalance() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+
+	now := time.Now()
+	self := hostRegistration{
+		Pid:       os.Getpid(),
+		Limit:     c.limit,
+		Weight:    c.weight,
+		Active:    c.active,
+		Heartbeat: now,
+	}
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	tmpFn := c.fn + ".tmp"
+	err = os.WriteFile(tmpFn, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFn, c.fn)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(c.fn))
+	if err != nil {
+		return err
+	}
+	limit := c.limit
+	totalWeight := 0
+	processes := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err != nil {
+			continue
+		}
+		fn := filepath.Join(filepath.Dir(c.fn), name)
+		data, err := os.ReadFile(fn)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		var r hostRegistration
+		if json.Unmarshal(data, &r) != nil {
+			continue
+		}
+		if now.Sub(r.Heartbeat) > coordinatorStaleAfter {
+			os.Remove(fn)
+			continue
+		}
+		if !r.Active {
+			continue
+		}
+		processes++
+		totalWeight += r.Weight
+		if r.Limit > 0 && r.Limit < limit {
+			limit = r.Limit
+		}
+	}
+
+	share := limit
+	if totalWeight > 0 && c.active {
+		share = limit * int64(c.weight) / int64(totalWeight)
+	}
+	if share < 1 {
+		share = 1
+	}
+	c.processes = processes
+	c.sharedLimit = limit
+	if share != c.share {
+		c.share = share
+		c.bucket.SetRate(share)
+	}
+	return nil
+}
+
+// run rebalances periodically until ctx is done, and then removes the registration.
+// The registration should also be removed with close when the process exits.
+func (c *hostCoordinator) run(ctx context.Context) {
+	ticker := time.NewTicker(coordinatorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.close()
+			return
+		case <-ticker.C:
+			if err := c.rebalance(); err != nil {
+				fmt.Fprintf(os.Stderr, "\nError coordinating with other shrimp processes: %v\n", err)
+			}
+		}
+	}
+}
+
+func (c *hostCoordinator) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	os.Remove(c.fn)
+}
+
+func (c *hostCoordinator) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("%s shared by %d active shrimp process(es) (this process: %s)", formatLimit2(c.sharedLimit), c.processes, formatLimit2(c.share))
+}
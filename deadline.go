@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// The rate required to meet the deadline is increased by this factor to account for retries and variations in throughput
+const deadlineSafetyMargin = 1.1
+
+// The lowest rate that deadline mode will set (same as the lowest rate that can be set with the keyboard controls)
+const deadlineMinRate = 1e3
+
+// deadlineRate returns the lowest rate that transfers the remaining bytes before the deadline, using the schedule as an upper bound. The safety margin is included in the returned rate.
+// ok is false if the deadline can not be met under the schedule.
+func deadlineRate(bytes int64, deadline time.Time, schedule *Schedule, now time.Time) (int64, bool) {
+	if !deadline.After(now) {
+		return 0, false
+	}
+	if bytes <= 0 {
+		return deadlineMinRate, true
+	}
+
+	meetsDeadline := func(rate float64) bool {
+		completion, ok := simulateTransfer(bytes, schedule, now, func(scheduledRate int64, first bool) int64 {
+			if scheduledRate == 0 || float64(scheduledRate) > rate {
+				return int64(math.Ceil(rate))
+			}
+			return scheduledRate
+		})
+		return ok && !completion.After(deadline)
+	}
+
+	// Without a schedule the rate can be calculated directly, otherwise do a binary search using the schedule simulation
+	low := float64(bytes) / deadline.Sub(now).Seconds()
+	high := low
+	if schedule != nil {
+		high = 1e12
+		if !meetsDeadline(high) {
+			return 0, false
+		}
+		for high-low > math.Max(1, low*0.001) {
+			mid := (low + high) / 2
+			if meetsDeadline(mid) {
+				high = mid
+			} else {
+				low = mid
+			}
+		}
+	}
+
+	rate := int64(math.Ceil(high * deadlineSafetyMargin))
+	if rate < deadlineMinRate {
+		rate = deadlineMinRate
+	}
+	return rate, true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// deviceInfo identifies a block device (e.g. /dev/sdb or /dev/mapper/vg-disk), so that an upload is not resumed from a different device. It is stored in the upload state.
+type deviceInfo struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Fingerprint string `json:"fingerprint,omitempty"` // The serial number, UUIDs, etc. of the device (Linux only)
+}
+
+func isBlockDevice(stat os.FileInfo) bool {
+	return stat.Mode()&os.ModeDevice != 0 && stat.Mode()&os.ModeCharDevice == 0
+}
+
+// newDeviceInfo gets the size of a block device, since os.Stat reports a size of zero for devices.
+func newDeviceInfo(fn string) (*deviceInfo, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := blockDeviceSize(f)
+	if err != nil || size == 0 {
+		size, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if size == 0 {
+		return nil, errors.New("the device is empty or its size could not be determined")
+	}
+	return &deviceInfo{
+		Path:        fn,
+		Size:        size,
+		Fingerprint: deviceFingerprint(fn),
+	}, nil
+}
+
+func (d *deviceInfo) String() string {
+	if d.Fingerprint == "" {
+		return d.Path
+	}
+	return fmt.Sprintf("%s (%s)", d.Path, d.Fingerprint)
+}
+
+// sameDevice returns an error that describes the difference if the device is not the one that the upload was started with.
+func (d *deviceInfo) sameDevice(other *deviceInfo) error {
+	if d.Size != other.Size {
+		return fmt.Errorf("the size of the device has changed (%d bytes, now %d bytes)", other.Size, d.Size)
+	}
+	if d.Fingerprint != "" && other.Fingerprint != "" && d.Fingerprint != other.Fingerprint {
+		return fmt.Errorf("the upload was started from %s, but this is %s", other, d)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func blockDeviceSize(f *os.File) (int64, error) {
+	var size uint64
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
+
+// deviceFingerprint returns the names that udev has given to the device. The names in /dev/disk/by-id contain the model and serial number of disks (and the names of LVM and dm-crypt volumes), and /dev/disk/by-uuid and /dev/disk/by-partuuid identify file systems and partitions.
+func deviceFingerprint(fn string) string {
+	target, err := filepath.EvalSymlinks(fn)
+	if err != nil {
+		return ""
+	}
+	var names []string
+	for _, dir := range []string{"/dev/disk/by-id", "/dev/disk/by-uuid", "/dev/disk/by-partuuid"} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			path, err := filepath.EvalSymlinks(filepath.Join(dir, entry.Name()))
+			if err == nil && path == target {
+				names = append(names, filepath.Base(dir)+"/"+entry.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
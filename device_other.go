@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// The size is determined by seeking to the end of the device instead
+func blockDeviceSize(f *os.File) (int64, error) {
+	return 0, errors.New("not supported")
+}
+
+func deviceFingerprint(fn string) string {
+	return ""
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Client-side encryption (--client-side-encrypt)
+//
+// The file is encrypted with a random data key using AES-256-GCM, in chunks of 64 KiB. Every chunk has its own nonce (a random prefix followed by the chunk index) and authentication tag, so any part of the encrypted data can be produced without encrypting what comes before it. This makes it possible to resume an upload. The last chunk is authenticated as such, so that a truncated object fails to decrypt.
+//
+// The data key is encrypted (wrapped) with a key file or with a key derived from a passphrase using PBKDF2. The parameters are stored in the object metadata and at the beginning of the encrypted data, so that the object can be decrypted with "shrimp decrypt" using only the key file or the passphrase.
+//
+// Encrypted data:
+//
+//	"SHRIMPE1"  magic
+//	uint32      length of the parameters (big endian)
+//	JSON        the parameters (encryptionParams)
+//	chunks      each chunk is the encrypted data followed by a 16 byte authentication tag
+const (
+	encryptionMagic        = "SHRIMPE1"
+	encryptionVersion      = 1
+	encryptionAlgorithm    = "AES-256-GCM"
+	encryptionChunkSize    = 64 * kiB
+	encryptionMaxChunkSize = 16 * 1024 * kiB // Larger chunks are rejected before the buffers are allocated, since the header is not authenticated
+	encryptionMetadataKey  = "shrimp-encryption"
+	encryptionNoncePrefix  = 4  // The nonce is the random prefix followed by the chunk index (8 bytes)
+	aesGCMTagSize          = 16 // The size of the authentication tag
+	encryptionKDFNone      = "none"
+	encryptionKDFPBKDF2    = "pbkdf2-sha256"
+	encryptionPBKDF2Rounds = 600000
+)
+
+// encryptionParams describes how the data was encrypted. The values are fixed-length so that the size of the encrypted data only depends on the size of the file.
+type encryptionParams struct {
+	Version     int    `json:"v"`
+	Algorithm   string `json:"alg"`
+	ChunkSize   int    `json:"chunk"`
+	NoncePrefix string `json:"nonce"` // base64
+	WrappedKey  string `json:"key"`   // base64, the nonce followed by the encrypted data key
+	KDF         string `json:"kdf"`
+	Salt        string `json:"salt,omitempty"` // base64
+	Iterations  int    `json:"iter,omitempty"`
+	Size        int64  `json:"size"` // The size of the unencrypted data
+}
+
+// encryptionSecret is the key file or the passphrase that protects the data key.
+type encryptionSecret struct {
+	key        []byte
+	passphrase []byte
+}
+
+// readEncryptionSecret reads the key file or the passphrase. Exactly one of them has to be given.
+func readEncryptionSecret(keySource, passphraseSource string) (*encryptionSecret, error) {
+	if keySource != "" && passphraseSource != "" {
+		return nil, errors.New("--client-side-key and --client-side-passphrase can not be used together")
+	} else if keySource != "" {
+		key, err := readKey(keySource)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --client-side-key: %w", err)
+		}
+		return &encryptionSecret{key: key}, nil
+	} else if passphraseSource != "" {
+		passphrase, err := readSecret(passphraseSource)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --client-side-passphrase: %w", err)
+		}
+		passphrase = bytes.TrimRight(passphrase, "\r\n")
+		if len(passphrase) == 0 {
+			return nil, errors.New("the passphrase is empty")
+		}
+		return &encryptionSecret{passphrase: passphrase}, nil
+	}
+	return nil, errors.New("either --client-side-key or --client-side-passphrase is required")
+}
+
+// keyEncryptionKey returns the key that wraps the data key.
+func (s *encryptionSecret) keyEncryptionKey(p *encryptionParams) ([]byte, error) {
+	switch p.KDF {
+	case encryptionKDFNone:
+		if s.key == nil {
+			return nil, errors.New("the data was encrypted with a key file, use --client-side-key")
+		}
+		return s.key, nil
+	case encryptionKDFPBKDF2:
+		if s.passphrase == nil {
+			return nil, errors.New("the data was encrypted with a passphrase, use --client-side-passphrase")
+		}
+		salt, err := base64.StdEncoding.DecodeString(p.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid salt: %w", err)
+		}
+		return pbkdf2.Key(s.passphrase, salt, p.Iterations, keyLength, sha256.New), nil
+	}
+	return nil, fmt.Errorf("unsupported key derivation function: %s", p.KDF)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// newEncryptionParams generates a data key for a file of the given size and wraps it with the secret.
+func newEncryptionParams(secret *encryptionSecret, size int64) (*encryptionParams, []byte, error) {
+	p := &encryptionParams{
+		Version:   encryptionVersion,
+		Algorithm: encryptionAlgorithm,
+		ChunkSize: encryptionChunkSize,
+		KDF:       encryptionKDFNone,
+		Size:      size,
+	}
+	if secret.passphrase != nil {
+		salt, err := randomBytes(16)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.KDF = encryptionKDFPBKDF2
+		p.Salt = base64.StdEncoding.EncodeToString(salt)
+		p.Iterations = encryptionPBKDF2Rounds
+	}
+	noncePrefix, err := randomBytes(encryptionNoncePrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.NoncePrefix = base64.StdEncoding.EncodeToString(noncePrefix)
+
+	dataKey, err := randomBytes(keyLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	kek, err := secret.keyEncryptionKey(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	p.WrappedKey = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, dataKey, nil))
+	return p, dataKey, nil
+}
+
+// unwrapKey returns the data key. It fails if the secret is not the one that was used to encrypt the data.
+func (p *encryptionParams) unwrapKey(secret *encryptionSecret) ([]byte, error) {
+	if p.Version != encryptionVersion || p.Algorithm != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption (version %d, %s)", p.Version, p.Algorithm)
+	}
+	if p.ChunkSize <= 0 || p.ChunkSize > encryptionMaxChunkSize {
+		return nil, fmt.Errorf("unsupported chunk size (%d bytes)", p.ChunkSize)
+	}
+	kek, err := secret.keyEncryptionKey(p)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(p.WrappedKey)
+	if err != nil || len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("invalid wrapped key")
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("the key or passphrase is not the one that was used to encrypt the data")
+	}
+	return dataKey, nil
+}
+
+func (p *encryptionParams) String() string {
+	if p.KDF == encryptionKDFPBKDF2 {
+		return fmt.Sprintf("%s in %d KiB chunks, data key protected by a passphrase", p.Algorithm, p.ChunkSize/kiB)
+	}
+	return fmt.Sprintf("%s in %d KiB chunks, data key protected by a key file", p.Algorithm, p.ChunkSize/kiB)
+}
+
+func (p *encryptionParams) metadataValue() string {
+	return string(jsonMustMarshal(p))
+}
+
+func (p *encryptionParams) header() []byte {
+	params := jsonMustMarshal(p)
+	header := make([]byte, len(encryptionMagic)+4, len(encryptionMagic)+4+len(params))
+	copy(header, encryptionMagic)
+	binary.BigEndian.PutUint32(header[len(encryptionMagic):], uint32(len(params)))
+	return append(header, params...)
+}
+
+func (p *encryptionParams) numChunks() int64 {
+	// An empty file still has one (empty) chunk, so that it can be authenticated
+	if p.Size == 0 {
+		return 1
+	}
+	return (p.Size + int64(p.ChunkSize) - 1) / int64(p.ChunkSize)
+}
+
+// encryptedSize returns the size of the encrypted data, including the header.
+func (p *encryptionParams) encryptedSize() int64 {
+	return int64(len(p.header())) + p.Size + p.numChunks()*int64(aesGCMTagSize)
+}
+
+// plaintextOffset returns how much of the unencrypted data comes before an offset in the encrypted data.
+func (p *encryptionParams) plaintextOffset(offset int64) int64 {
+	pos := offset - int64(len(p.header()))
+	if pos <= 0 {
+		return 0
+	}
+	encryptedChunkSize := int64(p.ChunkSize + aesGCMTagSize)
+	plaintext := pos/encryptedChunkSize*int64(p.ChunkSize) + min(pos%encryptedChunkSize, int64(p.ChunkSize))
+	return min(plaintext, p.Size)
+}
+
+func (p *encryptionParams) chunkNonce(index int64) ([]byte, error) {
+	prefix, err := base64.StdEncoding.DecodeString(p.NoncePrefix)
+	if err != nil || len(prefix) != encryptionNoncePrefix {
+		return nil, errors.New("invalid nonce")
+	}
+	nonce := make([]byte, encryptionNoncePrefix+8)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[encryptionNoncePrefix:], uint64(index))
+	return nonce, nil
+}
+
+// chunkAdditionalData marks the last chunk, so that truncating the data at a chunk boundary is detected.
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptingReaderAt encrypts the file on the fly. Since the chunks are encrypted independently, it can read from any offset, which is needed to upload the parts.
+type encryptingReaderAt struct {
+	src    io.ReaderAt
+	params *encryptionParams
+	aead   cipher.AEAD
+	header []byte
+	size   int64
+
+	mu         sync.Mutex
+	chunkIndex int64 // The chunk that is in the buffer, -1 if none
+	chunk      []byte
+	plaintext  []byte
+}
+
+func newEncryptingReaderAt(src io.ReaderAt, params *encryptionParams, dataKey []byte) (*encryptingReaderAt, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingReaderAt{
+		src:        src,
+		params:     params,
+		aead:       aead,
+		header:     params.header(),
+		size:       params.encryptedSize(),
+		chunkIndex: -1,
+		plaintext:  make([]byte, params.ChunkSize),
+	}, nil
+}
+
+func (r *encryptingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		if pos < int64(len(r.header)) {
+			n += copy(p[n:], r.header[pos:])
+			continue
+		}
+		pos -= int64(len(r.header))
+		encryptedChunkSize := int64(r.params.ChunkSize + aesGCMTagSize)
+		index := pos / encryptedChunkSize
+		if index != r.chunkIndex {
+			err := r.encryptChunk(index)
+			if err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], r.chunk[pos-index*encryptedChunkSize:])
+	}
+	return n, nil
+}
+
+func (r *encryptingReaderAt) encryptChunk(index int64) error {
+	start := index * int64(r.params.ChunkSize)
+	length := int64(r.params.ChunkSize)
+	if start+length > r.params.Size {
+		length = r.params.Size - start
+	}
+	plaintext := r.plaintext[:length]
+	n, err := r.src.ReadAt(plaintext, start)
+	if err == io.EOF && n == len(plaintext) {
+		err = nil
+	}
+	if err == io.EOF {
+		return fmt.Errorf("the file is smaller than expected (%d bytes), has it been modified?", r.params.Size)
+	} else if err != nil {
+		return err
+	}
+	nonce, err := r.params.chunkNonce(index)
+	if err != nil {
+		return err
+	}
+	r.chunk = r.aead.Seal(r.chunk[:0], nonce, plaintext, chunkAdditionalData(index == r.params.numChunks()-1))
+	r.chunkIndex = index
+	return nil
+}
+
+// readEncryptionHeader reads the parameters from the beginning of the encrypted data.
+func readEncryptionHeader(r io.Reader) (*encryptionParams, error) {
+	header := make([]byte, len(encryptionMagic)+4)
+	_, err := io.ReadFull(r, header)
+	if err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("the data was not encrypted by shrimp")
+	}
+	length := binary.BigEndian.Uint32(header[len(encryptionMagic):])
+	if length > 64*kiB {
+		return nil, errors.New("the encryption header is too large")
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the encryption header: %w", err)
+	}
+	var p encryptionParams
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %w", err)
+	}
+	return &p, nil
+}
+
+// decryptStream decrypts data that was encrypted with --client-side-encrypt.
+func decryptStream(r io.Reader, w io.Writer, secret *encryptionSecret) error {
+	br := bufio.NewReaderSize(r, encryptionChunkSize+aesGCMTagSize)
+	p, err := readEncryptionHeader(br)
+	if err != nil {
+		return err
+	}
+	dataKey, err := p.unwrapKey(secret)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	numChunks := p.numChunks()
+	buf := make([]byte, p.ChunkSize+aesGCMTagSize)
+	var plaintext []byte
+	var written int64
+	for index := int64(0); index < numChunks; index++ {
+		length := int64(p.ChunkSize)
+		if index == numChunks-1 {
+			length = p.Size - index*int64(p.ChunkSize)
+		}
+		chunk := buf[:length+aesGCMTagSize]
+		_, err := io.ReadFull(br, chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("the encrypted data is truncated")
+		} else if err != nil {
+			return err
+		}
+		nonce, err := p.chunkNonce(index)
+		if err != nil {
+			return err
+		}
+		plaintext, err = aead.Open(plaintext[:0], nonce, chunk, chunkAdditionalData(index == numChunks-1))
+		if err != nil {
+			return fmt.Errorf("chunk %d failed authentication, the data has been modified or corrupted", index)
+		}
+		n, err := w.Write(plaintext)
+		written += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return errors.New("unexpected data after the last chunk")
+	}
+	if written != p.Size {
+		return fmt.Errorf("decrypted %d bytes but expected %d bytes", written, p.Size)
+	}
+	return nil
+}
+
+// decryptFile implements "shrimp decrypt". The input and the output can be "-" for stdin and stdout. The output file is removed if decryption fails.
+func decryptFile(input, output string, secret *encryptionSecret) error {
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if output == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		err := decryptStream(r, w, secret)
+		if err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	if strings.HasPrefix(output, "s3://") {
+		return errors.New("the output must be a local file")
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = decryptStream(r, w, secret)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/stefansundin/shrimp/flowrate"
+)
+
+// The simulation gives up if the upload is not predicted to complete within this time
+const etaHorizon = 5 * 365 * 24 * time.Hour
+
+// estimateCompletion walks forward through the schedule to predict when the remaining bytes will have been transferred.
+// rate is used until the next schedule transition, after which the rates from the schedule are used.
+// Unlimited periods are estimated using fallbackRate (e.g. the measured transfer rate).
+// ok is false if the completion time can not be predicted.
+func estimateCompletion(bytes, rate, fallbackRate int64, schedule *Schedule, now time.Time) (completion time.Time, ok bool) {
+	return simulateTransfer(bytes, schedule, now, func(scheduledRate int64, first bool) int64 {
+		if first {
+			scheduledRate = rate
+		}
+		if scheduledRate == 0 {
+			return fallbackRate
+		}
+		return scheduledRate
+	})
+}
+
+// simulateTransfer steps through the schedule transitions, using effectiveRate to translate the scheduled rate to the rate that the transfer will actually have.
+func simulateTransfer(bytes int64, schedule *Schedule, now time.Time, effectiveRate func(scheduledRate int64, first bool) int64) (time.Time, bool) {
+	t := now
+	remaining := float64(bytes)
+	first := true
+	for remaining > 0 && t.Sub(now) < etaHorizon {
+		var scheduledRate int64
+		until := now.Add(etaHorizon)
+		if schedule != nil {
+			scheduledRate, until = schedule.rateAt(t)
+		}
+
+		r := effectiveRate(scheduledRate, first)
+		if r <= 0 {
+			return time.Time{}, false
+		}
+		first = false
+
+		duration := until.Sub(t).Seconds()
+		if duration*float64(r) >= remaining {
+			return t.Add(time.Duration(remaining / float64(r) * 1e9)), true
+		}
+		remaining -= duration * float64(r)
+		t = until
+	}
+	if remaining > 0 {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// estimateStatusCompletion predicts when the upload will complete based on the current transfer status.
+// Without a schedule this is the same estimate that flowrate makes.
+func estimateStatusCompletion(s flowrate.Status, rate int64, schedule *Schedule) (time.Time, bool) {
+	if schedule == nil {
+		if s.TotalTimeRem == 0 {
+			return time.Time{}, false
+		}
+		return time.Now().Add(s.TotalTimeRem), true
+	}
+	currentRate := s.CurRate
+	if currentRate == 0 {
+		currentRate = rate
+	}
+	return estimateCompletion(s.TotalBytesRem, currentRate, s.CurRate, schedule, time.Now())
+}
+
+// formatTimeRemaining formats the remaining time for the progress line, including the time when the upload is predicted to complete.
+func formatTimeRemaining(s flowrate.Status, rate int64, schedule *Schedule) string {
+	completion, ok := estimateStatusCompletion(s, rate, schedule)
+	if !ok {
+		return fmt.Sprintf("%s remaining", s.TotalTimeRem.Round(time.Second))
+	}
+	return fmt.Sprintf("%s remaining, done at %s", time.Until(completion).Round(time.Second), formatTime(completion))
+}
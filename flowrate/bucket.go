@@ -0,0 +1,222 @@
+package flowrate
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// bucketBurstDuration determines the automatic burst size, which is the number
+// of bytes that can be transferred in this period at the current rate.
+const bucketBurstDuration = 100 * time.Millisecond
+
+// bucketMaxAutoBurst is the largest automatic burst size.
+const bucketMaxAutoBurst = 4 << 20
+
+// Bucket is a token bucket rate limiter. One token corresponds to one byte.
+// Unlike Monitor.Limit, which restricts the flow per sample, a Bucket keeps
+// track of fractional tokens, so it is accurate at both very low and very high
+// rates. Buckets can be arranged in a hierarchy where a child bucket also draws
+// tokens from its parent, which allows a global limit to be shared by many
+// readers and writers.
+type Bucket struct {
+	mu     sync.Mutex // Mutex guarding access to all internal fields
+	parent *Bucket    // Parent bucket (nil for the root)
+	rate   float64    // Tokens added per second (unlimited when <= 0)
+	burst  int64      // Bucket capacity (automatic when <= 0)
+	tokens float64    // Available tokens (negative when tokens are reserved ahead of time)
+	last   time.Time  // Last time tokens were added
+	total  int64      // Total number of tokens taken
+}
+
+// NewBucket creates a new token bucket that allows rate bytes per second (0
+// for unlimited). If burst <= 0, the burst size is derived from the rate.
+func NewBucket(rate, burst int64) *Bucket {
+	b := &Bucket{rate: float64(rate), burst: burst, last: time.Now()}
+	b.tokens = float64(b.capacity())
+	return b
+}
+
+// NewChild creates a new bucket that also draws tokens from b.
+func (b *Bucket) NewChild(rate, burst int64) *Bucket {
+	c := NewBucket(rate, burst)
+	c.parent = b
+	return c
+}
+
+// Parent returns the parent bucket, or nil if b is a root bucket.
+func (b *Bucket) Parent() *Bucket {
+	return b.parent
+}
+
+// Rate returns the current rate in bytes per second (0 for unlimited).
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(math.Max(b.rate, 0))
+}
+
+// SetRate changes the rate to new bytes per second and returns the previous
+// setting. Tokens that have accumulated so far are kept.
+func (b *Bucket) SetRate(new int64) (old int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	old = int64(math.Max(b.rate, 0))
+	wasUnlimited := b.rate <= 0
+	b.rate = float64(new)
+	if wasUnlimited {
+		b.tokens = float64(b.capacity())
+	} else if capacity := float64(b.capacity()); b.tokens > capacity {
+		b.tokens = capacity
+	}
+	return
+}
+
+// SetBurst changes the burst size and returns the previous setting. If new <=
+// 0, the burst size is derived from the rate.
+func (b *Bucket) SetBurst(new int64) (old int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, b.burst = b.burst, new
+	return
+}
+
+// Total returns the total number of bytes that have been taken from the bucket.
+func (b *Bucket) Total() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+// Wait blocks until n tokens are available in b and all of its ancestors, or
+// until ctx is done. The tokens are returned to the buckets if ctx is done
+// before the wait is over.
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	now := time.Now()
+	var delay time.Duration
+	for c := b; c != nil; c = c.parent {
+		if d := c.reserve(now, n); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.Return(n)
+		return ctx.Err()
+	}
+}
+
+// Take takes up to want tokens without blocking and returns how many were
+// taken, which is limited by the bucket with the fewest available tokens.
+func (b *Bucket) Take(want int) int {
+	now := time.Now()
+	n := want
+	for c := b; c != nil; c = c.parent {
+		c.mu.Lock()
+		c.advance(now)
+		if c.rate > 0 && c.tokens < float64(n) {
+			n = int(math.Max(c.tokens, 0))
+		}
+		c.mu.Unlock()
+	}
+	for c := b; c != nil && n > 0; c = c.parent {
+		c.reserve(now, n)
+	}
+	return n
+}
+
+// Return gives back n unused tokens to b and all of its ancestors.
+func (b *Bucket) Return(n int) {
+	if n <= 0 {
+		return
+	}
+	for c := b; c != nil; c = c.parent {
+		c.mu.Lock()
+		c.total -= int64(n)
+		if c.rate > 0 {
+			c.tokens = math.Min(c.tokens+float64(n), float64(c.capacity()))
+		}
+		c.mu.Unlock()
+	}
+}
+
+// acquire takes up to want tokens, limited by the burst sizes in the hierarchy
+// so that the flow stays smooth. If block is false, it only takes the tokens
+// that are available immediately.
+func (b *Bucket) acquire(ctx context.Context, want int, block bool) (int, error) {
+	n := want
+	for c := b; c != nil; c = c.parent {
+		c.mu.Lock()
+		if c.rate > 0 {
+			if capacity := c.capacity(); int64(n) > capacity {
+				n = int(capacity)
+			}
+		}
+		c.mu.Unlock()
+	}
+	if !block {
+		return b.Take(n), nil
+	}
+	if err := b.Wait(ctx, n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// reserve takes n tokens from b (going into debt if necessary) and returns how
+// long the caller has to wait until the debt is paid off.
+func (b *Bucket) reserve(now time.Time, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	b.total += int64(n)
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// advance adds the tokens that have accumulated since the last call.
+func (b *Bucket) advance(now time.Time) {
+	if b.rate > 0 && now.After(b.last) {
+		b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*b.rate, float64(b.capacity()))
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
+
+// capacity returns the burst size, which is derived from the rate unless it
+// has been set explicitly. At least one token fits in the bucket.
+func (b *Bucket) capacity() int64 {
+	if b.burst > 0 {
+		return b.burst
+	}
+	c := int64(b.rate * bucketBurstDuration.Seconds())
+	if c > bucketMaxAutoBurst {
+		c = bucketMaxAutoBurst
+	}
+	if c < 1 {
+		c = 1
+	}
+	return c
+}
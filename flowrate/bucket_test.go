@@ -0,0 +1,147 @@
+package flowrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitAll takes n tokens from b in chunks and returns how long it took.
+func waitAll(t *testing.T, b *Bucket, n, chunk int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	for n > 0 {
+		c := min(chunk, n)
+		if err := b.Wait(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+		n -= c
+	}
+	return time.Since(start)
+}
+
+// checkDuration fails the test if d is not within 20% of want.
+func checkDuration(t *testing.T, d, want time.Duration) {
+	t.Helper()
+	if d < want*8/10 || d > want*12/10 {
+		t.Errorf("took %s, expected about %s", d, want)
+	}
+}
+
+func TestBucketRate(t *testing.T) {
+	tests := []struct {
+		rate  int64
+		n     int
+		chunk int
+	}{
+		{rate: 1e3, n: 500, chunk: 10},
+		{rate: 100e6, n: 50e6, chunk: 32 << 10},
+	}
+	for _, tt := range tests {
+		b := NewBucket(tt.rate, 0)
+		burst := b.capacity()
+		d := waitAll(t, b, tt.n, tt.chunk)
+		// The bucket starts out full, so the first burst is not limited
+		want := time.Duration(float64(int64(tt.n)-burst) / float64(tt.rate) * float64(time.Second))
+		checkDuration(t, d, want)
+		if total := b.Total(); total != int64(tt.n) {
+			t.Errorf("rate %d: total is %d, expected %d", tt.rate, total, tt.n)
+		}
+	}
+}
+
+func TestBucketWaitCancelled(t *testing.T) {
+	parent := NewBucket(1e3, 100)
+	child := parent.NewChild(1e3, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The wait is longer than the burst, so it has to be cancelled
+	err := child.Wait(ctx, 1000)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	for name, b := range map[string]*Bucket{"child": child, "parent": parent} {
+		if total := b.Total(); total != 0 {
+			t.Errorf("%s: total is %d after the cancelled wait, expected 0", name, total)
+		}
+	}
+
+	// The reserved tokens are back, so the burst is available right away
+	if n := child.Take(100); n != 100 {
+		t.Errorf("took %d tokens from the child, expected 100", n)
+	}
+	if total := parent.Total(); total != 100 {
+		t.Errorf("parent: total is %d, expected 100", total)
+	}
+}
+
+func TestBucketChildrenShareParent(t *testing.T) {
+	const rate = 100e3
+	const n = 25000
+	parent := NewBucket(rate, 0)
+	burst := parent.capacity()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		child := parent.NewChild(0, 0)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			waitAll(t, child, n, 1000)
+		}()
+	}
+	wg.Wait()
+	d := time.Since(start)
+
+	want := time.Duration(float64(2*n-burst) / rate * float64(time.Second))
+	checkDuration(t, d, want)
+	if total := parent.Total(); total != 2*n {
+		t.Errorf("parent: total is %d, expected %d", total, 2*n)
+	}
+}
+
+func TestBucketUnlimited(t *testing.T) {
+	b := NewBucket(1e3, 0)
+	if old := b.SetRate(0); old != 1e3 {
+		t.Errorf("SetRate returned %d, expected 1000", old)
+	}
+	if rate := b.Rate(); rate != 0 {
+		t.Errorf("rate is %d, expected 0", rate)
+	}
+	d := waitAll(t, b, 100e6, 1<<20)
+	if d > 100*time.Millisecond {
+		t.Errorf("took %s without a limit", d)
+	}
+	if n := b.Take(1 << 30); n != 1<<30 {
+		t.Errorf("took %d tokens, expected %d", n, 1<<30)
+	}
+}
+
+func TestReaderSetLimitUnlimited(t *testing.T) {
+	data := make([]byte, 10<<20)
+	r := NewReader(bytes.NewReader(data), 1e3, false)
+	b := NewBucket(0, 0)
+	r.SetBucket(context.Background(), b)
+	if rate := b.Rate(); rate != 1e3 {
+		t.Fatalf("the bucket rate is %d, expected the limit of the reader", rate)
+	}
+	r.SetLimit(0)
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("read %d bytes, expected %d", n, len(data))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("took %s without a limit", d)
+	}
+}
@@ -5,6 +5,7 @@
 package flowrate
 
 import (
+	"context"
 	"errors"
 	"io"
 )
@@ -21,6 +22,7 @@ type Limiter interface {
 	SetTransferSize(bytes int64)
 	SetLimit(new int64) (old int64)
 	SetBlocking(new bool) (old bool)
+	SetBucket(ctx context.Context, b *Bucket)
 }
 
 // Reader implements io.ReadCloser with a restriction on the rate of data
@@ -34,11 +36,25 @@ type Reader struct {
 
 	skipFirstPass bool // Whether or not to skip rate limiting on the first pass
 	pass          int  // Keep track of how many passes have been made
+
+	bucket *Bucket         // Token bucket used for limiting instead of the Monitor (optional)
+	ctx    context.Context // Cancels waiting for the bucket
 }
 
 // NewReader restricts all Read operations on r to limit bytes per second.
 func NewReader(r io.ReadSeeker, limit int64, skipFirstPass bool) *Reader {
-	return &Reader{r, New(0, 0), limit, true, skipFirstPass, 0}
+	return &Reader{r, New(0, 0), limit, true, skipFirstPass, 0, nil, nil}
+}
+
+// SetBucket makes the reader use a token bucket for limiting instead of the
+// per-sample limit of the Monitor. The current limit is applied to the bucket,
+// and SetLimit changes the rate of the bucket from now on. A Read call that is
+// waiting for tokens returns ctx.Err() when ctx is done.
+func (r *Reader) SetBucket(ctx context.Context, b *Bucket) {
+	r.bucket, r.ctx = b, ctx
+	if b != nil {
+		b.SetRate(r.limit)
+	}
 }
 
 // Read reads up to len(p) bytes into p without exceeding the current transfer
@@ -51,6 +67,19 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 		return
 	}
 
+	if r.bucket != nil {
+		var want int
+		if want, err = r.bucket.acquire(r.ctx, len(p), r.block); err != nil {
+			return
+		}
+		p = p[:want]
+		if len(p) > 0 {
+			n, err = r.IO(r.ReadSeeker.Read(p))
+			r.bucket.Return(len(p) - n)
+		}
+		return
+	}
+
 	p = p[:r.Limit(len(p), r.limit, r.block)]
 	if len(p) > 0 {
 		n, err = r.IO(r.ReadSeeker.Read(p))
@@ -73,6 +102,9 @@ func (r *Reader) Seek(offset int64, whence int) (n int64, err error) {
 // the previous setting.
 func (r *Reader) SetLimit(new int64) (old int64) {
 	old, r.limit = r.limit, new
+	if r.bucket != nil {
+		r.bucket.SetRate(new)
+	}
 	return
 }
 
@@ -101,13 +133,27 @@ type Writer struct {
 
 	limit int64 // Rate limit in bytes per second (unlimited when <= 0)
 	block bool  // What to do when no new bytes can be written due to the limit
+
+	bucket *Bucket         // Token bucket used for limiting instead of the Monitor (optional)
+	ctx    context.Context // Cancels waiting for the bucket
 }
 
 // NewWriter restricts all Write operations on w to limit bytes per second. The
 // transfer rate and the default blocking behavior (true) can be changed
 // directly on the returned *Writer.
 func NewWriter(w io.Writer, limit int64) *Writer {
-	return &Writer{w, New(0, 0), limit, true}
+	return &Writer{w, New(0, 0), limit, true, nil, nil}
+}
+
+// SetBucket makes the writer use a token bucket for limiting instead of the
+// per-sample limit of the Monitor. The current limit is applied to the bucket,
+// and SetLimit changes the rate of the bucket from now on. A Write call that is
+// waiting for tokens returns ctx.Err() when ctx is done.
+func (w *Writer) SetBucket(ctx context.Context, b *Bucket) {
+	w.bucket, w.ctx = b, ctx
+	if b != nil {
+		b.SetRate(w.limit)
+	}
 }
 
 // Write writes len(p) bytes from p to the underlying data stream without
@@ -116,9 +162,21 @@ func NewWriter(w io.Writer, limit int64) *Writer {
 func (w *Writer) Write(p []byte) (n int, err error) {
 	var c int
 	for len(p) > 0 && err == nil {
-		s := p[:w.Limit(len(p), w.limit, w.block)]
+		var s []byte
+		if w.bucket != nil {
+			var want int
+			if want, err = w.bucket.acquire(w.ctx, len(p), w.block); err != nil {
+				return
+			}
+			s = p[:want]
+		} else {
+			s = p[:w.Limit(len(p), w.limit, w.block)]
+		}
 		if len(s) > 0 {
 			c, err = w.IO(w.Writer.Write(s))
+			if w.bucket != nil {
+				w.bucket.Return(len(s) - c)
+			}
 		} else {
 			return n, ErrLimit
 		}
@@ -132,6 +190,9 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 // the previous setting.
 func (w *Writer) SetLimit(new int64) (old int64) {
 	old, w.limit = w.limit, new
+	if w.bucket != nil {
+		w.bucket.SetRate(new)
+	}
 	return
 }
 
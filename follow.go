@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Following a growing file (--follow)
+//
+// With --follow, the file is uploaded while it is still being written (e.g. a recording or a database WAL stream). A part is uploaded as soon as the file has grown past the end of it, and the file is polled while shrimp waits for more data. The file is complete when its size and modification time have not changed for the quiet period (--follow-quiet-period), or when the sentinel file (--follow-sentinel) exists. The rest of the file is then uploaded as the last part and the upload is completed.
+
+// How often the file is checked while waiting for it to grow
+const followPollInterval = time.Second
+
+type fileFollower struct {
+	f           *os.File
+	quietPeriod time.Duration
+	sentinel    string
+	size        int64
+	modTime     time.Time
+	lastChange  time.Time
+	complete    bool
+	reason      string // Why the file is considered complete
+}
+
+func newFileFollower(f *os.File, quietPeriod time.Duration, sentinel string) (*fileFollower, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileFollower{
+		f:           f,
+		quietPeriod: quietPeriod,
+		sentinel:    sentinel,
+		size:        stat.Size(),
+		modTime:     stat.ModTime(),
+		lastChange:  time.Now(),
+	}, nil
+}
+
+// poll checks if the file has grown or is complete.
+func (ff *fileFollower) poll() error {
+	if ff.complete {
+		return nil
+	}
+	// The sentinel is checked before the size, so that everything that was written before the sentinel was created is included
+	sentinelExists := false
+	if ff.sentinel != "" {
+		_, err := os.Stat(ff.sentinel)
+		if err == nil {
+			sentinelExists = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	stat, err := ff.f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < ff.size {
+		return fmt.Errorf("the file has been truncated (from %d to %d bytes)", ff.size, stat.Size())
+	}
+	if stat.Size() != ff.size || !stat.ModTime().Equal(ff.modTime) {
+		ff.size = stat.Size()
+		ff.modTime = stat.ModTime()
+		ff.lastChange = time.Now()
+	}
+	if sentinelExists {
+		ff.complete = true
+		ff.reason = fmt.Sprintf("%s exists", ff.sentinel)
+	} else if ff.quietPeriod > 0 && time.Since(ff.lastChange) >= ff.quietPeriod {
+		ff.complete = true
+		ff.reason = fmt.Sprintf("unchanged for %s", ff.quietPeriod)
+	}
+	return nil
+}
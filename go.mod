@@ -10,8 +10,10 @@ require (
 	github.com/aws/aws-sdk-go-v2/credentials v1.17.30
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.61.0
 	github.com/aws/smithy-go v1.20.4
+	github.com/klauspost/compress v1.17.9
 	github.com/pkg/term v1.1.0
 	github.com/stefansundin/go-zflag v1.1.1
+	golang.org/x/crypto v0.26.0
 	golang.org/x/sys v0.24.0
 )
 
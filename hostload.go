@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stefansundin/shrimp/flowrate"
+)
+
+// The lowest rate that the interface limiter will set, so that the upload never stops completely
+const interfaceMinRate = 10e3
+
+// interfaceLimiter lowers the rate of a bucket when there is other outgoing traffic on a network interface, so that the total traffic stays below a target.
+// The counters are read from /proc/net/dev (Linux only).
+type interfaceLimiter struct {
+	mu      sync.Mutex
+	name    string
+	target  int64
+	bucket  *flowrate.Bucket
+	lastTx  int64
+	lastOwn int64
+	last    time.Time
+	other   float64 // Smoothed rate of the other traffic
+}
+
+// readInterfaceTxBytes returns the number of bytes transmitted on a network interface.
+func readInterfaceTxBytes(name string) (int64, error) {
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		iface, counters, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(iface) != name {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			return 0, fmt.Errorf("unexpected format in /proc/net/dev: %s", line)
+		}
+		return strconv.ParseInt(fields[8], 10, 64)
+	}
+	return 0, fmt.Errorf("network interface %s not found", name)
+}
+
+// The bucket must be used for all of shrimp's uploads, since shrimp's own traffic is known from the number of bytes that have been taken from it.
+func newInterfaceLimiter(name string, target int64, bucket *flowrate.Bucket) (*interfaceLimiter, error) {
+	tx, err := readInterfaceTxBytes(name)
+	if err != nil {
+		return nil, err
+	}
+	bucket.SetRate(target)
+	return &interfaceLimiter{
+		name:    name,
+		target:  target,
+		bucket:  bucket,
+		lastTx:  tx,
+		lastOwn: bucket.Total(),
+		last:    time.Now(),
+	}, nil
+}
+
+// update reads the interface counters and adjusts the rate to the part of the target that is not used by other traffic.
+func (l *interfaceLimiter) update(now time.Time) error {
+	tx, err := readInterfaceTxBytes(l.name)
+	if err != nil {
+		return err
+	}
+	own := l.bucket.Total()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elapsed := now.Sub(l.last).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+	other := float64((tx-l.lastTx)-(own-l.lastOwn)) / elapsed
+	if other < 0 || tx < l.lastTx {
+		// shrimp's own bytes are counted when they are read from the file, which can be a little before they are sent (or the counter wrapped)
+		other = 0
+	}
+	l.other = 0.5*l.other + 0.5*other
+	l.lastTx, l.lastOwn, l.last = tx, own, now
+
+	rate := int64(math.Max(float64(l.target)-l.other, interfaceMinRate))
+	l.bucket.SetRate(rate)
+	return nil
+}
+
+// run updates the rate every second until ctx is done.
+func (l *interfaceLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := l.update(now)
+			if err != nil && lastErr == nil {
+				fmt.Fprintf(os.Stderr, "\nError reading the counters for %s: %v\n", l.name, err)
+			}
+			lastErr = err
+		}
+	}
+}
+
+func (l *interfaceLimiter) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return fmt.Sprintf("%s (target: %s, other traffic: %s, limit: %s)", l.name, formatLimit2(l.target), formatSize(int64(l.other))+"/s", formatLimit2(l.bucket.Rate()))
+}
+
+// readLoadAverage returns the 1-minute load average from /proc/loadavg.
+func readLoadAverage() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("unexpected format in /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readIOPressure returns the percentage of the last 10 seconds where at least one task was stalled on I/O, from /proc/pressure/io (requires Linux 4.20 or later).
+func readIOPressure() (float64, error) {
+	data, err := os.ReadFile("/proc/pressure/io")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if v, found := strings.CutPrefix(field, "avg10="); found {
+				return strconv.ParseFloat(v, 64)
+			}
+		}
+	}
+	return 0, errors.New("unexpected format in /proc/pressure/io")
+}
+
+// checkHostLoad returns a description of the problem if the load average or the I/O pressure is above the maximum (a maximum of 0 disables the check).
+func checkHostLoad(maxLoad, maxIOPressure float64) (string, error) {
+	if maxLoad > 0 {
+		load, err := readLoadAverage()
+		if err != nil {
+			return "", err
+		}
+		if load > maxLoad {
+			return fmt.Sprintf("The load average is %.2f (max: %.2f)", load, maxLoad), nil
+		}
+	}
+	if maxIOPressure > 0 {
+		pressure, err := readIOPressure()
+		if err != nil {
+			return "", err
+		}
+		if pressure > maxIOPressure {
+			return fmt.Sprintf("The I/O pressure is %.1f%% (max: %.1f%%)", pressure, maxIOPressure), nil
+		}
+	}
+	return "", nil
+}
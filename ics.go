@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurring calendar events are expanded up to this far into the future
+const calendarHorizon = 366 * 24 * time.Hour
+
+// The bandwidth limit of a calendar event can be specified with an X-SHRIMP-BWLIMIT property, or in the summary, e.g. "Backups (bwlimit: 200k)"
+// Other events are ignored, even if the summary looks like a rate (e.g. "2024" or "5k run")
+var calendarSummaryRateRegexp = regexp.MustCompile(`(?i)\bbwlimit\s*[:=]\s*([^\s,;)]+)`)
+
+type calendarProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+type calendarEvent struct {
+	summary string
+	start   time.Time
+	end     time.Time
+	rate    int64
+	rrule   string
+	exdates []time.Time
+}
+
+// readCalendar reads an iCalendar file and turns the events that have a bandwidth limit into schedule blocks.
+// Recurring events are expanded until calendarHorizon, and events that have already ended are skipped.
+// The calendar can specify the default rate and quotas with the X-SHRIMP-DEFAULT-BWLIMIT and X-SHRIMP-QUOTA properties.
+func readCalendar(fn string, now time.Time) (*Schedule, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Unfold long lines (continuation lines start with a space or a tab)
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var defaultRate int64
+	var quotas []Quota
+	var events []calendarEvent
+	var eventProps []calendarProperty
+	inEvent := false
+	nested := 0
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		prop, err := parseCalendarProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if prop.name == "BEGIN" && prop.value == "VEVENT" {
+			inEvent = true
+			eventProps = nil
+		} else if prop.name == "END" && prop.value == "VEVENT" {
+			inEvent = false
+			event, err := parseCalendarEvent(eventProps)
+			if err != nil {
+				return nil, err
+			}
+			if event != nil {
+				events = append(events, *event)
+			}
+		} else if inEvent {
+			// Skip nested components such as VALARM
+			if prop.name == "BEGIN" {
+				nested++
+			} else if prop.name == "END" {
+				nested--
+			} else if nested == 0 {
+				eventProps = append(eventProps, prop)
+			}
+		} else if prop.name == "X-SHRIMP-DEFAULT-BWLIMIT" {
+			defaultRate, err = parseRate(strings.TrimSpace(prop.value))
+			if err != nil {
+				return nil, err
+			}
+		} else if prop.name == "X-SHRIMP-QUOTA" {
+			quota, err := parseQuota(prop.value)
+			if err != nil {
+				return nil, err
+			}
+			quotas = append(quotas, quota)
+		}
+	}
+
+	horizon := now.Add(calendarHorizon)
+	var blocks []ScheduleBlock
+	var summaries []string
+	for _, event := range events {
+		starts := []time.Time{event.start}
+		if event.rrule != "" {
+			starts, err = expandRecurrence(event.start, event.rrule, horizon)
+			if err != nil {
+				return nil, fmt.Errorf("event %q: %w", event.summary, err)
+			}
+		}
+		duration := event.end.Sub(event.start)
+		for _, start := range starts {
+			end := start.Add(duration)
+			if !end.After(now) || containsTime(event.exdates, start) {
+				continue
+			}
+			blocks = append(blocks, ScheduleBlock{rate: event.rate, start: start, end: end})
+			summaries = append(summaries, event.summary)
+		}
+	}
+
+	indexes := make([]int, len(blocks))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return blocks[indexes[i]].start.Before(blocks[indexes[j]].start)
+	})
+
+	if len(blocks) == 0 {
+		return nil, errors.New("schedule is empty (the calendar does not have any upcoming events with a bandwidth limit)")
+	}
+	// An occurrence that overlaps an earlier one is skipped, with one warning per pair of events
+	type overlap struct {
+		skipped, kept string
+	}
+	type overlapCount struct {
+		first time.Time
+		count int
+	}
+	overlaps := make(map[overlap]*overlapCount)
+	var overlapOrder []overlap
+	var sortedBlocks []ScheduleBlock
+	var lastSummary string
+	for _, index := range indexes {
+		block := blocks[index]
+		if n := len(sortedBlocks); n > 0 && sortedBlocks[n-1].end.After(block.start) {
+			o := overlap{summaries[index], lastSummary}
+			if overlaps[o] == nil {
+				overlaps[o] = &overlapCount{first: block.start}
+				overlapOrder = append(overlapOrder, o)
+			}
+			overlaps[o].count++
+			continue
+		}
+		sortedBlocks = append(sortedBlocks, block)
+		lastSummary = summaries[index]
+	}
+	for _, o := range overlapOrder {
+		c := overlaps[o]
+		fmt.Fprintf(warningOutput(), "Warning: Skipping %d occurrence(s) of %q that overlap with %q (the first at %s).\n", c.count, o.skipped, o.kept, c.first.Format(time.RFC3339))
+	}
+
+	return &Schedule{defaultRate, sortedBlocks, quotas}, nil
+}
+
+// parseCalendarProperty parses a content line, e.g. "DTSTART;TZID=Europe/Stockholm:20261018T220000".
+func parseCalendarProperty(line string) (calendarProperty, error) {
+	// Find the colon that separates the value (parameter values may contain quoted colons)
+	quoted := false
+	sep := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			sep = i
+			break
+		}
+	}
+	if sep == -1 {
+		return calendarProperty{}, fmt.Errorf("invalid calendar line: %s", line)
+	}
+
+	prop := calendarProperty{params: make(map[string]string), value: line[sep+1:]}
+	nameAndParams := strings.Split(line[:sep], ";")
+	prop.name = strings.ToUpper(nameAndParams[0])
+	for _, param := range nameAndParams[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			prop.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return prop, nil
+}
+
+// parseCalendarEvent returns nil if the event does not have a bandwidth limit.
+func parseCalendarEvent(props []calendarProperty) (*calendarEvent, error) {
+	var event calendarEvent
+	var rateValue, durationValue string
+	var allDay bool
+	for _, prop := range props {
+		var err error
+		switch prop.name {
+		case "SUMMARY":
+			event.summary = unescapeCalendarText(prop.value)
+		case "DTSTART":
+			event.start, allDay, err = parseCalendarTime(prop)
+		case "DTEND":
+			event.end, _, err = parseCalendarTime(prop)
+		case "DURATION":
+			durationValue = prop.value
+		case "RRULE":
+			event.rrule = prop.value
+		case "EXDATE":
+			for _, v := range strings.Split(prop.value, ",") {
+				var t time.Time
+				t, _, err = parseCalendarTime(calendarProperty{prop.name, prop.params, v})
+				if err != nil {
+					break
+				}
+				event.exdates = append(event.exdates, t)
+			}
+		case "X-SHRIMP-BWLIMIT":
+			rateValue = strings.TrimSpace(prop.value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %q: %w", event.summary, err)
+		}
+	}
+
+	if rateValue == "" {
+		m := calendarSummaryRateRegexp.FindStringSubmatch(event.summary)
+		if m == nil {
+			// Not an event for shrimp
+			return nil, nil
+		}
+		rateValue = m[1]
+	}
+	var err error
+	event.rate, err = parseRate(rateValue)
+	if err != nil {
+		return nil, fmt.Errorf("event %q: invalid bandwidth limit: %w", event.summary, err)
+	}
+
+	if event.start.IsZero() {
+		return nil, fmt.Errorf("event %q: missing DTSTART", event.summary)
+	}
+	if event.end.IsZero() {
+		if durationValue != "" {
+			d, err := parseCalendarDuration(durationValue)
+			if err != nil {
+				return nil, fmt.Errorf("event %q: %w", event.summary, err)
+			}
+			event.end = event.start.Add(d)
+		} else if allDay {
+			event.end = event.start.AddDate(0, 0, 1)
+		} else {
+			return nil, fmt.Errorf("event %q: missing DTEND", event.summary)
+		}
+	}
+	if !event.end.After(event.start) {
+		return nil, fmt.Errorf("event %q: the event must end after it starts", event.summary)
+	}
+	return &event, nil
+}
+
+// parseCalendarTime parses a DATE or DATE-TIME value. Times without a time zone are interpreted as local time.
+func parseCalendarTime(prop calendarProperty) (time.Time, bool, error) {
+	v := prop.value
+	if prop.params["VALUE"] == "DATE" || len(v) == 8 {
+		t, err := time.ParseInLocation("20060102", v, time.Local)
+		return t, true, err
+	}
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") {
+		loc = time.UTC
+		v = v[:len(v)-1]
+	} else if tzid := prop.params["TZID"]; tzid != "" {
+		// Some calendar programs use time zone names that Go does not know about (e.g. Windows time zone names), fall back to local time for those
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", v, loc)
+	return t, false, err
+}
+
+// parseCalendarDuration parses an iCalendar duration, e.g. "PT1H30M" or "P1D".
+func parseCalendarDuration(s string) (time.Duration, error) {
+	orig := s
+	sign := time.Duration(1)
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	}
+	s = strings.TrimPrefix(s, "+")
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("invalid duration: %s", orig)
+	}
+	s = s[1:]
+
+	var d time.Duration
+	inTime := false
+	num := ""
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			num += string(c)
+			continue
+		}
+		if c == 'T' {
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", orig)
+		}
+		num = ""
+		switch {
+		case c == 'W' && !inTime:
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration: %s", orig)
+		}
+	}
+	if num != "" {
+		return 0, fmt.Errorf("invalid duration: %s", orig)
+	}
+	return sign * d, nil
+}
+
+var calendarWeekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// expandRecurrence returns the start times of a recurring event until the horizon.
+// Only the commonly used parts of RRULE are supported: FREQ (DAILY, WEEKLY, MONTHLY, YEARLY), INTERVAL, COUNT, UNTIL and BYDAY (with DAILY and WEEKLY).
+func expandRecurrence(dtstart time.Time, rrule string, horizon time.Time) ([]time.Time, error) {
+	var freq string
+	interval := 1
+	count := 0
+	var until time.Time
+	var byday []time.Weekday
+	for _, part := range strings.Split(rrule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid RRULE: %s", rrule)
+		}
+		var err error
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			freq = strings.ToUpper(kv[1])
+		case "INTERVAL":
+			interval, err = strconv.Atoi(kv[1])
+			if err == nil && interval < 1 {
+				err = errors.New("INTERVAL must be positive")
+			}
+		case "COUNT":
+			count, err = strconv.Atoi(kv[1])
+		case "UNTIL":
+			until, _, err = parseCalendarTime(calendarProperty{value: kv[1], params: map[string]string{}})
+			if err == nil && len(kv[1]) == 8 {
+				// Include occurrences on the last day
+				until = until.AddDate(0, 0, 1).Add(-time.Second)
+			}
+		case "BYDAY":
+			for _, v := range strings.Split(kv[1], ",") {
+				wd, ok := calendarWeekdays[strings.ToUpper(v)]
+				if !ok {
+					return nil, fmt.Errorf("unsupported BYDAY value in RRULE: %s", v)
+				}
+				byday = append(byday, wd)
+			}
+		case "WKST":
+			// Only Monday (the default) is supported, but it only matters for weekly rules with INTERVAL > 1
+		default:
+			return nil, fmt.Errorf("unsupported RRULE part: %s", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid RRULE: %s (%w)", rrule, err)
+		}
+	}
+	if len(byday) > 0 && freq != "DAILY" && freq != "WEEKLY" {
+		return nil, fmt.Errorf("BYDAY is only supported with FREQ=DAILY or FREQ=WEEKLY")
+	}
+	if until.IsZero() || until.After(horizon) {
+		until = horizon
+	}
+
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, dtstart.Location())
+	}
+	hasWeekday := func(wd time.Weekday) bool {
+		for _, v := range byday {
+			if v == wd {
+				return true
+			}
+		}
+		return false
+	}
+
+	var starts []time.Time
+	add := func(t time.Time) bool {
+		if t.After(until) || (count > 0 && len(starts) >= count) {
+			return false
+		}
+		starts = append(starts, t)
+		return true
+	}
+
+	switch freq {
+	case "DAILY":
+		for i := 0; ; i++ {
+			t := at(dtstart.Year(), dtstart.Month(), dtstart.Day()+i*interval)
+			if len(byday) > 0 && !hasWeekday(t.Weekday()) && !t.After(until) {
+				continue
+			}
+			if !add(t) {
+				break
+			}
+		}
+	case "WEEKLY":
+		if len(byday) == 0 {
+			byday = []time.Weekday{dtstart.Weekday()}
+		}
+		// Weeks start on Monday
+		sort.Slice(byday, func(i, j int) bool {
+			return (byday[i]+6)%7 < (byday[j]+6)%7
+		})
+		monday := dtstart.Day() - int(dtstart.Weekday()+6)%7
+	weeks:
+		for w := 0; ; w++ {
+			for _, wd := range byday {
+				t := at(dtstart.Year(), dtstart.Month(), monday+w*7*interval+int(wd+6)%7)
+				if t.Before(dtstart) {
+					continue
+				}
+				if !add(t) {
+					break weeks
+				}
+			}
+		}
+	case "MONTHLY":
+		for i := 0; ; i++ {
+			t := at(dtstart.Year(), dtstart.Month()+time.Month(i*interval), dtstart.Day())
+			if t.Day() != dtstart.Day() && !t.After(until) {
+				// Skip months that do not have this day
+				continue
+			}
+			if !add(t) {
+				break
+			}
+		}
+	case "YEARLY":
+		for i := 0; ; i++ {
+			t := at(dtstart.Year()+i*interval, dtstart.Month(), dtstart.Day())
+			if t.Day() != dtstart.Day() && !t.After(until) {
+				continue
+			}
+			if !add(t) {
+				break
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported RRULE frequency: %s", freq)
+	}
+	return starts, nil
+}
+
+func unescapeCalendarText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' || s[i] == 'N' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func containsTime(times []time.Time, t time.Time) bool {
+	for _, v := range times {
+		if v.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
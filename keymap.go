@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// keymap holds the keyboard controls. The keys and the rate steps can be changed in the [keymap] and [steps] sections of the config file:
+//
+//	[keymap]
+//	increase = q w e r
+//	decrease = a s d f
+//	schedule = b
+//
+//	[steps]
+//	increase = 1m 10m 100m 250m
+//	decrease = 1m 10m 100m 250m
+//	digit = 10m
+type keymap struct {
+	info           rune
+	unlimited      rune
+	schedule       rune
+	prompt         rune
+	extendOverride rune
+	pauseAfterPart rune
+	pause          rune
+	help           rune
+	increase       []rune
+	decrease       []rune
+
+	increaseSteps []int64
+	decreaseSteps []int64
+	digitStep     int64 // The digit keys set the rate to N times this step (0 is 10 times)
+}
+
+func defaultKeymap() *keymap {
+	return &keymap{
+		info:           'i',
+		unlimited:      'u',
+		schedule:       'r',
+		prompt:         'l',
+		extendOverride: 'o',
+		pauseAfterPart: 'p',
+		pause:          ' ',
+		help:           '?',
+		increase:       []rune{'a', 's', 'd', 'f'},
+		decrease:       []rune{'z', 'x', 'c', 'v'},
+		increaseSteps:  []int64{1e3, 10e3, 100e3, 250e3},
+		decreaseSteps:  []int64{1e3, 10e3, 100e3, 250e3},
+		digitStep:      100e3,
+	}
+}
+
+func parseKey(s string) (rune, error) {
+	if s == "space" {
+		return ' ', nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 || size != len(s) {
+		return 0, fmt.Errorf("invalid key: %q (must be a single character or \"space\")", s)
+	}
+	if r >= '0' && r <= '9' {
+		return 0, fmt.Errorf("invalid key: %q (the digits are reserved)", s)
+	}
+	return r, nil
+}
+
+func keyName(r rune) string {
+	if r == ' ' {
+		return "[space]"
+	}
+	return string(r)
+}
+
+// keyPhrase is used in messages, e.g. "Press the space key to resume."
+func keyPhrase(r rune) string {
+	if r == ' ' {
+		return "the space key"
+	}
+	return fmt.Sprintf("the %s key", string(r))
+}
+
+// loadKeymap applies the [keymap] and [steps] sections of the config file to the default keymap.
+func loadKeymap(c *iniFile) (*keymap, error) {
+	k := defaultKeymap()
+	keys := c.section("keymap")
+	singleKeys := map[string]*rune{
+		"info":             &k.info,
+		"unlimited":        &k.unlimited,
+		"schedule":         &k.schedule,
+		"prompt":           &k.prompt,
+		"extend-override":  &k.extendOverride,
+		"pause-after-part": &k.pauseAfterPart,
+		"pause":            &k.pause,
+		"help":             &k.help,
+	}
+	multiKeys := map[string]*[]rune{
+		"increase": &k.increase,
+		"decrease": &k.decrease,
+	}
+	if keys != nil {
+		for _, name := range keys.keys {
+			value := keys.values[name]
+			if p, ok := singleKeys[name]; ok {
+				r, err := parseKey(value)
+				if err != nil {
+					return nil, fmt.Errorf("[keymap] %s: %w", name, err)
+				}
+				*p = r
+			} else if p, ok := multiKeys[name]; ok {
+				var runes []rune
+				for _, s := range strings.Fields(value) {
+					r, err := parseKey(s)
+					if err != nil {
+						return nil, fmt.Errorf("[keymap] %s: %w", name, err)
+					}
+					runes = append(runes, r)
+				}
+				*p = runes
+			} else {
+				return nil, fmt.Errorf("[keymap] unknown action: %s", name)
+			}
+		}
+	}
+
+	steps := c.section("steps")
+	if steps != nil {
+		for _, name := range steps.keys {
+			value := steps.values[name]
+			var rates []int64
+			for _, s := range strings.Fields(value) {
+				rate, err := parseRate(s)
+				if err != nil {
+					return nil, fmt.Errorf("[steps] %s: %w", name, err)
+				}
+				if rate <= 0 {
+					return nil, fmt.Errorf("[steps] %s: the steps must be greater than zero", name)
+				}
+				rates = append(rates, rate)
+			}
+			if name == "increase" {
+				k.increaseSteps = rates
+			} else if name == "decrease" {
+				k.decreaseSteps = rates
+			} else if name == "digit" {
+				if len(rates) != 1 {
+					return nil, fmt.Errorf("[steps] digit: expected a single rate")
+				}
+				k.digitStep = rates[0]
+			} else {
+				return nil, fmt.Errorf("[steps] unknown setting: %s", name)
+			}
+		}
+	}
+
+	if len(k.increase) != len(k.increaseSteps) {
+		return nil, fmt.Errorf("the number of increase keys (%d) does not match the number of increase steps (%d)", len(k.increase), len(k.increaseSteps))
+	}
+	if len(k.decrease) != len(k.decreaseSteps) {
+		return nil, fmt.Errorf("the number of decrease keys (%d) does not match the number of decrease steps (%d)", len(k.decrease), len(k.decreaseSteps))
+	}
+
+	// Check for keys that are bound more than once
+	used := make(map[rune]bool)
+	all := []rune{k.info, k.unlimited, k.schedule, k.prompt, k.extendOverride, k.pauseAfterPart, k.pause, k.help}
+	all = append(all, k.increase...)
+	all = append(all, k.decrease...)
+	for _, r := range all {
+		if used[r] {
+			return nil, fmt.Errorf("the key %s is bound more than once", keyName(r))
+		}
+		used[r] = true
+	}
+	return k, nil
+}
+
+// step returns the rate change for a key, or false if the key is not an increase or decrease key.
+func (k *keymap) step(r rune) (int64, bool) {
+	for i, key := range k.increase {
+		if key == r {
+			return k.increaseSteps[i], true
+		}
+	}
+	for i, key := range k.decrease {
+		if key == r {
+			return -k.decreaseSteps[i], true
+		}
+	}
+	return 0, false
+}
+
+func joinKeys(keys []rune) string {
+	names := make([]string, len(keys))
+	for i, r := range keys {
+		names[i] = keyName(r)
+	}
+	return strings.Join(names, " ")
+}
+
+func joinSteps(steps []int64) string {
+	names := make([]string, len(steps))
+	for i, step := range steps {
+		names[i] = formatSize(step) + "/s"
+	}
+	if len(names) > 1 {
+		names[len(names)-1] = "or " + names[len(names)-1]
+	}
+	return strings.Join(names, ", ")
+}
+
+// helpLines returns the description of the keyboard controls that is shown by the help key and in the full-screen mode.
+func (k *keymap) helpLines() []string {
+	var lines []string
+	width := len("Ctrl-C")
+	for _, keys := range []string{joinKeys(k.increase), joinKeys(k.decrease), keyName(k.pause)} {
+		if len(keys) > width {
+			width = len(keys)
+		}
+	}
+	add := func(keys, description string) {
+		lines = append(lines, fmt.Sprintf("%-*s - %s", width, keys, description))
+	}
+	add(keyName(k.info), "print information about the upload")
+	add(keyName(k.unlimited), "set to unlimited transfer rate")
+	add(keyName(k.schedule), "return to the schedule (clears the manual override)")
+	if len(k.increase) > 0 {
+		add(joinKeys(k.increase), "increase transfer limit by "+joinSteps(k.increaseSteps))
+	}
+	if len(k.decrease) > 0 {
+		add(joinKeys(k.decrease), "decrease transfer limit by "+joinSteps(k.decreaseSteps))
+	}
+	add("0-9", fmt.Sprintf("limit the transfer rate to N × %s/s (0 is %s/s)", formatSize(k.digitStep), formatSize(10*k.digitStep)))
+	add(keyName(k.prompt), "type a transfer limit (e.g. \"35m\", \"+5m\" or \"50%\")")
+	add(keyName(k.extendOverride), "extend the manual override by one hour")
+	add(keyName(k.pauseAfterPart), "pause transfer after current part")
+	add(keyName(k.pause), "pause transfer (sets transfer limit to 1 kB/s)")
+	add(keyName(k.help), "show this help")
+	add("Ctrl-C", "exit after current part")
+	lines = append(lines, strings.Repeat(" ", width+3)+"press twice to abort immediately")
+	return lines
+}
+
+// summary returns a one-line list of the keys.
+func (k *keymap) summary() string {
+	keys := []string{keyName(k.info), keyName(k.unlimited), keyName(k.schedule), joinKeys(k.increase), joinKeys(k.decrease), "0-9", keyName(k.prompt), keyName(k.extendOverride), keyName(k.pauseAfterPart), keyName(k.pause), "Ctrl-C"}
+	return fmt.Sprintf("Keys: %s (press %s for details)", strings.Join(keys, " "), keyName(k.help))
+}
+
+// skipEscapeSequence reads the rest of an escape sequence (e.g. from an arrow key) after the escape character, so that it is not handled as key presses. It returns false if the escape key was pressed on its own.
+func skipEscapeSequence(r *bufio.Reader) bool {
+	// The terminal sends the whole sequence at once, so nothing is buffered after an escape key press
+	if r.Buffered() == 0 {
+		return false
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return false
+	}
+	switch b {
+	case '[':
+		// CSI: parameter and intermediate bytes followed by a final byte
+		for r.Buffered() > 0 {
+			c, err := r.ReadByte()
+			if err != nil || (c >= 0x40 && c <= 0x7e) {
+				break
+			}
+		}
+		return true
+	case 'O':
+		// SS3 (e.g. F1-F4, or arrow keys in application mode)
+		if r.Buffered() > 0 {
+			r.ReadByte()
+		}
+		return true
+	}
+	r.UnreadByte()
+	return false
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile opens (or creates) fn and waits for an exclusive lock on it. The lock is released when the file is closed.
+func lockFile(fn string) (*os.File, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, new(windows.Overlapped))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -2,9 +2,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"crypto/sha1"
-	"crypto/tls"
 	"encoding/base32"
 	"errors"
 	"fmt"
@@ -12,13 +11,14 @@ import (
 	"io/fs"
 	"math"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	flag "github.com/stefansundin/go-zflag"
@@ -26,14 +26,15 @@ import (
 	"github.com/stefansundin/shrimp/terminal"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 const version = "0.2.0"
 
+// Exit code used when the upload was stopped by --stop-at or --run-for before it was completed
+const exitCodeStopped = 3
+
 var useDualStackEndpoint aws.DualStackEndpointState
 
 func init() {
@@ -61,36 +62,80 @@ func main() {
 }
 
 func run() (int, error) {
-	var profile, region, bwlimit, partSizeRaw, endpointURL, caBundle, scheduleFn, cacheControl, contentDisposition, contentEncoding, contentLanguage, contentType, expectedBucketOwner, tagging, storageClass, metadata, requestPayer, sse, sseCustomerAlgorithm, sseCustomerKey, sseKmsKeyId, checksumAlgorithm, objectLockLegalHoldStatus, objectLockMode, objectLockRetainUntilDate string
-	var bucketKeyEnabled, computeChecksum, noVerifySsl, noSignRequest, useAccelerateEndpoint, usePathStyle, mfaSecretFlag, force, dryrun, debug, versionFlag bool
-	var mfaDuration time.Duration
+	var configFn, profile, region, bwlimit, bwlimitBurst, hostBwlimit, networkInterface, interfaceBwlimit, partSizeRaw, endpointURL, caBundle, scheduleFn, quotaFlag, quotaStateFn, finishByFlag, startAtFlag, stopAtFlag, cacheControl, contentDisposition, contentEncoding, contentLanguage, contentType, expectedBucketOwner, tagging, storageClass, metadata, requestPayer, sse, sseCustomerAlgorithm, sseCustomerKey, sseKmsKeyId, checksumAlgorithm, objectLockLegalHoldStatus, objectLockMode, objectLockRetainUntilDate, acl, expires, websiteRedirect, sseKmsEncryptionContext, sseCustomerCopySource, sseCustomerCopySourceKey, clientSideKey, clientSidePassphrase, compressFormat, splitSizeRaw, followSentinel string
+	var grants []string
+	var bucketKeyEnabled, computeChecksum, noVerifySsl, noSignRequest, useAccelerateEndpoint, usePathStyle, mfaSecretFlag, background, clientSideEncrypt, tarFlag, splitLarge, followFlag, noGuessMimeType, sniffMimeType, tuiFlag, quiet, onlyShowErrors, noProgress, yes, force, dryrun, debug, versionFlag bool
+	var mfaDuration, overrideDuration, runFor, progressInterval, followQuietPeriod time.Duration
+	var hostWeight int
+	var maxLoad, maxIOPressure float64
 	var mfaSecret []byte
+	flag.StringVar(&configFn, "config", "", "Config file with default values for the parameters and the keyboard controls. Can also be set with SHRIMP_CONFIG. (default \"~/.config/shrimp/config\")")
 	flag.StringVar(&profile, "profile", "", "Use a specific profile from your credential file.")
 	flag.StringVar(&region, "region", "", "The bucket region. Avoids one API call.")
 	flag.StringVar(&bwlimit, "bwlimit", "", "Bandwidth limit. (e.g. \"2.5m\")")
+	flag.StringVar(&bwlimitBurst, "bwlimit-burst", "", "Burst size of the bandwidth limit. (default 100 ms worth of data, e.g. \"64k\")")
+	flag.StringVar(&hostBwlimit, "host-bwlimit", "", "Bandwidth limit shared by all shrimp processes on this host that use this option. The limit is split between the processes that are uploading. (e.g. \"10m\")")
+	flag.IntVar(&hostWeight, "host-weight", 1, "The weight of this process when splitting --host-bwlimit. A process with weight 2 gets twice the bandwidth of a process with weight 1.")
+	flag.BoolVar(&background, "background", false, "Background mode: measure the latency to the endpoint and automatically lower the bandwidth limit when it increases, so that other traffic is not disturbed. The regular limit (e.g. from --bwlimit or the schedule) is used as an upper bound.")
+	flag.StringVar(&networkInterface, "interface", "", "Network interface to monitor for other traffic when using --interface-bwlimit. (Linux only, e.g. \"eth0\")")
+	flag.StringVar(&interfaceBwlimit, "interface-bwlimit", "", "Keep the total outgoing traffic on --interface below this rate by lowering the bandwidth limit when there is other traffic. (e.g. \"10m\")")
+	flag.Float64Var(&maxLoad, "max-load", 0, "Wait before starting a new part while the 1-minute load average is above this value. (Linux only)")
+	flag.Float64Var(&maxIOPressure, "max-io-pressure", 0, "Wait before starting a new part while the I/O pressure (the percentage of time that tasks are stalled on I/O) is above this value. (Linux only, e.g. \"20\")")
 	flag.StringVar(&partSizeRaw, "part-size", "", "Override automatic part size. (e.g. \"128m\")")
 	flag.StringVar(&endpointURL, "endpoint-url", "", "Override the S3 endpoint URL. (for use with S3 compatible APIs)")
 	flag.StringVar(&caBundle, "ca-bundle", "", "The CA certificate bundle to use when verifying SSL certificates.")
-	flag.StringVar(&scheduleFn, "schedule", "", "Schedule file to use for automatically adjusting the bandwidth limit (see https://github.com/stefansundin/shrimp/discussions/4).")
+	flag.StringVar(&scheduleFn, "schedule", "", "Schedule file to use for automatically adjusting the bandwidth limit (see https://github.com/stefansundin/shrimp/discussions/4). iCalendar files (.ics) are also supported.")
+	flag.StringVar(&quotaFlag, "quota", "", "Data volume quota. shrimp pauses when the quota has been used up. (e.g. \"50GB/day\", \"300GB/week\" or \"1TB/month\", separate multiple quotas with a comma)")
+	flag.StringVar(&quotaStateFn, "quota-state", "", "File used to keep track of the quota usage across runs. (default \"~/.config/shrimp/quota.json\")")
+	flag.StringVar(&finishByFlag, "finish-by", "", "Deadline mode: use the lowest transfer rate that completes the upload by this time. The schedule is used as an upper bound. Must be formatted as a timestamp parameter. (e.g. \"2026-11-01T06:00\")")
+	flag.StringVar(&startAtFlag, "start-at", "", "Wait until this time before starting the upload. Accepts a timestamp parameter, a time of day (e.g. \"22:00\") or a duration (e.g. \"2h\").")
+	flag.StringVar(&stopAtFlag, "stop-at", "", fmt.Sprintf("Stop the upload after the part that is in progress at this time. Uses the same format as --start-at. shrimp exits with code %d if the upload was not completed.", exitCodeStopped))
+	flag.DurationVar(&runFor, "run-for", 0, "Stop the upload after it has been running for this duration. (see --stop-at)")
 	flag.StringVar(&cacheControl, "cache-control", "", "Specifies caching behavior for the object.")
 	flag.StringVar(&contentDisposition, "content-disposition", "", "Specifies presentational information for the object.")
 	flag.StringVar(&contentEncoding, "content-encoding", "", "Specifies what content encodings have been applied to the object.")
 	flag.StringVar(&contentLanguage, "content-language", "", "Specifies the language the content is in.")
-	flag.StringVar(&contentType, "content-type", "", "A standard MIME type describing the format of the object data.")
+	flag.StringVar(&contentType, "content-type", "", "A standard MIME type describing the format of the object data. By default it is guessed from the file extension.")
+	flag.BoolVar(&noGuessMimeType, "no-guess-mime-type", false, "Do not try to guess the Content-Type from the file extension.")
+	flag.BoolVar(&sniffMimeType, "sniff-mime-type", false, "Detect the Content-Type from the beginning of the file if it can not be guessed from the extension.")
 	flag.StringVar(&expectedBucketOwner, "expected-bucket-owner", "", "The account ID of the expected bucket owner.")
-	flag.StringVar(&tagging, "tagging", "", "The tag-set for the object. The tag-set must be encoded as URL Query parameters.")
+	flag.StringVar(&tagging, "tagging", "", "The tag-set for the object. Either URL Query parameters (key1=value1&key2=value2) or JSON ({\"key1\": \"value1\"} or {\"TagSet\": [{\"Key\": \"key1\", \"Value\": \"value1\"}]}). Use file:// or fileb:// to read it from a file.")
 	flag.StringVar(&storageClass, "storage-class", "", "Storage class. Known values: "+strings.Join(knownStorageClasses(), ", ")+".")
-	flag.StringVar(&metadata, "metadata", "", "A map of metadata to store with the object in S3. (JSON syntax is not supported)")
+	flag.StringVar(&metadata, "metadata", "", "A map of metadata to store with the object in S3. Either key1=value1,key2=value2 or JSON ({\"key1\": \"value1\"}). Use file:// or fileb:// to read it from a file.")
+	flag.StringVar(&acl, "acl", "", "Sets the ACL for the object. Possible values: "+strings.Join(knownCannedACLs(), ", ")+".")
+	flag.StringArrayVar(&grants, "grants", nil, "Grant specific permissions to individual users or groups. The format is Permission=Grantee_Type=Grantee_ID, where Permission is read, readacl, writeacl or full, and Grantee_Type is uri, emailaddress or id. Separate multiple grants with a space or use the parameter multiple times.")
+	flag.StringVar(&expires, "expires", "", "The date and time at which the object is no longer cacheable. Must be formatted as a timestamp parameter.")
+	flag.StringVar(&websiteRedirect, "website-redirect", "", "If the bucket is configured as a website, redirects requests for this object to another object in the same bucket or to an external URL.")
 	flag.StringVar(&requestPayer, "request-payer", "", "Confirms that the requester knows that they will be charged for the requests. Possible values: requester.")
 	flag.StringVar(&sse, "sse", "", "Specifies server-side encryption of the object in S3. Possible values: AES256, aws:kms, aws:kms:dsse.")
 	flag.StringVar(&sseCustomerAlgorithm, "sse-c", "", "Specifies server-side encryption using customer provided keys of the the object in S3. AES256 is the only valid value. If you provide this value, --sse-c-key must be specified as well.")
-	flag.StringVar(&sseCustomerKey, "sse-c-key", "", "The customer-provided encryption key to use to server-side encrypt the object in S3. The key provided should not be base64 encoded.")
+	flag.StringVar(&sseCustomerKey, "sse-c-key", "", "The customer-provided encryption key to use to server-side encrypt the object in S3. Either the raw key, or base64:<key>, fileb://<path>, env:<variable> or cmd:<command> to avoid putting the key on the command line. Keys that are not 32 bytes long are decoded as base64.")
 	flag.StringVar(&sseKmsKeyId, "sse-kms-key-id", "", "The customer-managed AWS Key Management Service (KMS) key ID that should be used to server-side encrypt the object in S3.")
+	flag.StringVar(&sseKmsEncryptionContext, "sse-kms-encryption-context", "", "The AWS KMS encryption context to use for the object. A JSON object with string values, optionally base64-encoded. Requires --sse aws:kms or aws:kms:dsse.")
+	flag.StringVar(&sseCustomerCopySource, "sse-c-copy-source", "", "This parameter is only used when copying an S3 object, so it has no effect with shrimp. It is accepted for compatibility with the aws cli.")
+	flag.StringVar(&sseCustomerCopySourceKey, "sse-c-copy-source-key", "", "This parameter is only used when copying an S3 object, so it has no effect with shrimp. It is accepted for compatibility with the aws cli.")
+	flag.StringVar(&compressFormat, "compress", "", "Compress the file while it is uploaded and set Content-Encoding. Possible values: "+strings.Join(compressionFormats, ", ")+". The size and checksum of the uncompressed file are stored in the metadata.")
+	flag.BoolVar(&tarFlag, "tar", false, "Upload a directory as a tar archive that is created on the fly (no temporary file is needed). The files are archived in a deterministic order, so that an interrupted upload can be resumed. A manifest of the archived files is stored as <key>"+manifestSuffix+". Can be combined with --compress.")
+	flag.BoolVar(&splitLarge, "split-large", false, "Upload a file that is larger than the maximum object size (5 TiB) as several objects (<key>.000, <key>.001, ...) and a manifest (<key>"+manifestSuffix+") with the order, sizes and SHA256 checksums of the chunks. Use \"shrimp join\" to download, verify and reassemble the file.")
+	flag.StringVar(&splitSizeRaw, "split-size", "", "The size of the chunks when using --split-large. Must be a multiple of the part size. (default the largest size allowed by the object size and part limits, e.g. \"1t\")")
+	flag.BoolVar(&followFlag, "follow", false, "Upload a file that is still being written. Parts are uploaded as soon as the file has grown past them, and the upload is completed when the file has stopped growing (see --follow-quiet-period and --follow-sentinel).")
+	flag.DurationVar(&followQuietPeriod, "follow-quiet-period", time.Minute, "With --follow, the file is complete when it has not changed for this duration. Use 0 to only rely on --follow-sentinel.")
+	flag.StringVar(&followSentinel, "follow-sentinel", "", "With --follow, the file is complete when this file exists. (e.g. a file that the writer creates when it is done)")
+	flag.BoolVar(&clientSideEncrypt, "client-side-encrypt", false, "Encrypt the file with AES-256-GCM before it is uploaded. Requires --client-side-key or --client-side-passphrase. Use \"shrimp decrypt\" to decrypt the object after downloading it.")
+	flag.StringVar(&clientSideKey, "client-side-key", "", "The 256-bit key that protects the data key of --client-side-encrypt. Uses the same format as --sse-c-key.")
+	flag.StringVar(&clientSidePassphrase, "client-side-passphrase", "", "The passphrase that protects the data key of --client-side-encrypt. Use env:<variable>, cmd:<command> or file://<path> to avoid putting the passphrase on the command line.")
 	flag.StringVar(&checksumAlgorithm, "checksum-algorithm", "", "The checksum algorithm to use for the object. Supported values: CRC32, CRC32C, SHA1, SHA256.")
 	flag.StringVar(&objectLockLegalHoldStatus, "object-lock-legal-hold-status", "", "Specifies whether a legal hold will be applied to this object. Possible values: ON, OFF.")
 	flag.StringVar(&objectLockMode, "object-lock-mode", "", "The Object Lock mode that you want to apply to this object. Possible values: GOVERNANCE, COMPLIANCE.")
 	flag.StringVar(&objectLockRetainUntilDate, "object-lock-retain-until-date", "", "The date and time when you want this object's Object Lock to expire. Must be formatted as a timestamp parameter. (e.g. \"2022-03-14T15:14:15Z\")")
+	flag.DurationVar(&overrideDuration, "override-duration", 0, "How long manual changes to the transfer limit last before returning to the schedule. (default until the schedule key is pressed)")
 	flag.DurationVar(&mfaDuration, "mfa-duration", time.Hour, "MFA duration. shrimp will prompt for another code after this duration. (max \"12h\")")
+	flag.BoolVar(&tuiFlag, "tui", false, "Use a full-screen terminal interface that shows the parts, a graph of the transfer rate and recent messages.")
+	flag.BoolVar(&quiet, "quiet", false, "Only display errors.")
+	flag.BoolVar(&onlyShowErrors, "only-show-errors", false, "Only display errors and warnings.")
+	flag.BoolVar(&noProgress, "no-progress", false, "Do not display the upload progress.")
+	flag.DurationVar(&progressInterval, "progress-interval", 0, "How often to display the upload progress. (default \"1s\", or \"1m\" when not running in a terminal)")
+	flag.BoolVar(&yes, "yes", false, "Answer yes to confirmation prompts. Without a terminal, shrimp exits instead of prompting.")
 	flag.BoolVar(&bucketKeyEnabled, "bucket-key-enabled", false, "Enables use of an S3 Bucket Key for object encryption with server-side encryption using AWS KMS (SSE-KMS).")
 	flag.BoolVar(&mfaSecretFlag, "mfa-secret", false, "Provide the MFA secret and shrimp will automatically generate TOTP codes. (useful if the upload takes longer than the allowed assume role duration)")
 	flag.BoolVar(&computeChecksum, "compute-checksum", false, "Compute checksum and add to SHA256SUMS file.")
@@ -99,7 +144,7 @@ func run() (int, error) {
 	flag.BoolVar(&useAccelerateEndpoint, "use-accelerate-endpoint", false, "Use S3 Transfer Acceleration.")
 	flag.BoolVar(&usePathStyle, "use-path-style", false, "Use S3 Path Style.")
 	flag.BoolVar(&force, "force", false, "Overwrite existing object.")
-	flag.BoolVar(&dryrun, "dryrun", false, "Checks if the upload was started previously and how much was completed. (use in combination with --bwlimit to calculate remaining time)")
+	flag.BoolVar(&dryrun, "dryrun", false, "Checks if the upload was started previously and how much was completed. (use in combination with --bwlimit or --schedule to calculate remaining time)")
 	flag.BoolVar(&debug, "debug", false, "Turn on debug logging.")
 	flag.BoolVar(&versionFlag, "version", false, "Print version number.")
 	flag.Usage = func() {
@@ -112,12 +157,16 @@ func run() (int, error) {
 		fmt.Fprintln(os.Stderr, "conditions. See the GNU General Public Licence version 3 for details.")
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintf(os.Stderr, "Usage: %s [parameters] <LocalPath> <S3Uri>\n", os.Args[0])
-		fmt.Fprintln(os.Stderr, "LocalPath must be a local file.")
+		fmt.Fprintf(os.Stderr, "       %s decrypt [parameters] <EncryptedFile> <OutputFile>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s join [parameters] <S3Uri> <OutputFile>\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "LocalPath must be a local file, or a directory when using --tar.")
 		fmt.Fprintln(os.Stderr, "S3Uri must have the format s3://<bucketname>/<key>.")
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "Parameters:")
 		flag.PrintDefaults()
 	}
+	// The parameters can be given after the subcommand (e.g. shrimp decrypt --client-side-passphrase env:PASSPHRASE in out)
+	flag.CommandLine.SetInterspersed(true)
 	flag.Parse()
 
 	if versionFlag {
@@ -127,12 +176,77 @@ func run() (int, error) {
 		flag.Usage()
 		fmt.Fprintln(os.Stderr)
 		return 1, errors.New("Error: LocalPath and S3Uri parameters are required!")
-	} else if flag.NArg() > 2 {
+	} else if flag.NArg() > 2 && !(flag.NArg() == 3 && (flag.Arg(0) == "decrypt" || flag.Arg(0) == "join")) {
 		flag.Usage()
 		fmt.Fprintln(os.Stderr)
 		return 1, errors.New("Error: Too many positional arguments!")
 	}
 
+	// Read the config file and apply it (and SHRIMP_* environment variables) to the flags that were not given on the command line
+	if configFn == "" {
+		configFn = os.Getenv("SHRIMP_CONFIG")
+	}
+	if configFn == "" {
+		var err error
+		configFn, err = defaultConfigFile()
+		if err != nil {
+			return 1, err
+		}
+	} else if _, err := os.Stat(configFn); err != nil {
+		return 1, fmt.Errorf("Error: %w", err)
+	}
+	configFile, err := readConfig(configFn)
+	if err != nil {
+		return 1, fmt.Errorf("Error loading %s: %w", configFn, err)
+	}
+	configBucket, _ := parseS3Uri(flag.Arg(1))
+	configSources, err := applyConfig(configFile, configFn, configBucket)
+	if err != nil {
+		return 1, fmt.Errorf("Error: %w", err)
+	}
+	if debug {
+		printConfig(configSources)
+	}
+
+	// Decrypt a file that was uploaded with --client-side-encrypt (use - for stdin and stdout)
+	if flag.NArg() == 3 && flag.Arg(0) == "decrypt" {
+		secret, err := readEncryptionSecret(clientSideKey, clientSidePassphrase)
+		if err != nil {
+			return 1, fmt.Errorf("Error: %w.", err)
+		}
+		err = decryptFile(flag.Arg(1), flag.Arg(2), secret)
+		if err != nil {
+			return 1, fmt.Errorf("Error decrypting %s: %w.", flag.Arg(1), err)
+		}
+		return 0, nil
+	}
+
+	// Use non-interactive mode when not running in a terminal (e.g. in cron jobs and CI)
+	interactive := terminal.IsTerminal(os.Stdin) && terminal.IsTerminal(os.Stderr)
+	if quiet && onlyShowErrors {
+		return 1, errors.New("Error: --quiet and --only-show-errors can not be used together.")
+	}
+	if tuiFlag && !interactive {
+		return 1, errors.New("Error: --tui requires a terminal.")
+	}
+	if tuiFlag && (quiet || onlyShowErrors) {
+		return 1, errors.New("Error: --tui can not be used together with --quiet or --only-show-errors.")
+	}
+	if quiet {
+		verbosity = outputErrors
+		noProgress = true
+	} else if onlyShowErrors {
+		verbosity = outputWarnings
+		noProgress = true
+	}
+	if progressInterval == 0 {
+		if interactive {
+			progressInterval = time.Second
+		} else {
+			progressInterval = time.Minute
+		}
+	}
+
 	if endpointURL != "" {
 		if !strings.HasPrefix(endpointURL, "http://") && !strings.HasPrefix(endpointURL, "https://") {
 			return 1, errors.New("Error: The endpoint URL must start with http:// or https://.")
@@ -152,13 +266,13 @@ func run() (int, error) {
 		}
 	}
 	if mfaDuration > 12*time.Hour {
-		fmt.Fprintln(os.Stderr, "Warning: MFA duration can not exceed 12 hours.")
+		fmt.Fprintln(warningOutput(), "Warning: MFA duration can not exceed 12 hours.")
 	}
 	if mfaSecretFlag {
-		fmt.Fprintln(os.Stderr, "Read more about the --mfa-secret feature here: https://github.com/stefansundin/shrimp/discussions/3")
+		fmt.Fprintln(infoOutput(), "Read more about the --mfa-secret feature here: https://github.com/stefansundin/shrimp/discussions/3")
 		secret, ok := os.LookupEnv("AWS_MFA_SECRET")
 		if ok {
-			fmt.Fprintln(os.Stderr, "MFA secret read from AWS_MFA_SECRET.")
+			fmt.Fprintln(infoOutput(), "MFA secret read from AWS_MFA_SECRET.")
 		} else {
 			fmt.Fprint(os.Stderr, "MFA secret: ")
 			_, err := fmt.Scanln(&secret)
@@ -167,7 +281,7 @@ func run() (int, error) {
 				return 1, err
 			}
 		}
-		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(infoOutput())
 		// Normalize secret
 		secret = strings.TrimSpace(secret)
 		if n := len(secret) % 8; n != 0 {
@@ -189,6 +303,68 @@ func run() (int, error) {
 		return 1, errors.New("Error: The destination must have the format s3://<bucketname>/<key>")
 	}
 
+	// Read the SSE-C key
+	var sseCustomerKeyEncoded, sseCustomerKeyMD5 string
+	if sseCustomerKey != "" {
+		if sseCustomerAlgorithm == "" {
+			return 1, errors.New("Error: --sse-c-key requires --sse-c.")
+		}
+		key, err := readKey(sseCustomerKey)
+		if err != nil {
+			return 1, fmt.Errorf("Error: Invalid value for --sse-c-key: %w.", err)
+		}
+		sseCustomerKeyEncoded, sseCustomerKeyMD5 = encodeSSECustomerKey(key)
+	} else if sseCustomerAlgorithm != "" {
+		return 1, errors.New("Error: --sse-c requires --sse-c-key.")
+	}
+
+	clientOpts := clientOptions{
+		profile:               profile,
+		region:                region,
+		endpointURL:           endpointURL,
+		caBundle:              caBundle,
+		noVerifySsl:           noVerifySsl,
+		noSignRequest:         noSignRequest,
+		usePathStyle:          usePathStyle,
+		useAccelerateEndpoint: useAccelerateEndpoint,
+		mfaDuration:           mfaDuration,
+		mfaSecret:             mfaSecret,
+		debug:                 debug,
+	}
+
+	// Download and reassemble a file that was uploaded with --split-large (use - for stdout)
+	if flag.NArg() == 3 && flag.Arg(0) == "join" {
+		client, err := newS3Client(bucket, clientOpts, &mfaPrompt{reader: os.Stdin})
+		if err != nil {
+			return 1, err
+		}
+		err = joinSplitObject(client, s3.GetObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			ExpectedBucketOwner:  aws.String(expectedBucketOwner),
+			RequestPayer:         s3Types.RequestPayer(requestPayer),
+			SSECustomerAlgorithm: aws.String(sseCustomerAlgorithm),
+			SSECustomerKey:       aws.String(sseCustomerKeyEncoded),
+			SSECustomerKeyMD5:    aws.String(sseCustomerKeyMD5),
+		}, flag.Arg(2))
+		if err != nil {
+			return 1, fmt.Errorf("Error joining s3://%s/%s: %w.", bucket, key, err)
+		}
+		fmt.Fprintln(infoOutput(), "All done!")
+		return 0, nil
+	}
+
+	// Read the key or passphrase for the client-side encryption
+	var cseSecret *encryptionSecret
+	if clientSideEncrypt {
+		cseSecret, err = readEncryptionSecret(clientSideKey, clientSidePassphrase)
+		if err != nil {
+			return 1, fmt.Errorf("Error: %w.", err)
+		}
+	} else if clientSideKey != "" || clientSidePassphrase != "" {
+		return 1, errors.New("Error: --client-side-key and --client-side-passphrase require --client-side-encrypt.")
+	}
+
 	// Construct the CreateMultipartUploadInput data
 	createMultipartUploadInput := s3.CreateMultipartUploadInput{
 		Bucket:                    aws.String(bucket),
@@ -206,16 +382,64 @@ func run() (int, error) {
 		RequestPayer:              s3Types.RequestPayer(requestPayer),
 		ServerSideEncryption:      s3Types.ServerSideEncryption(sse),
 		SSECustomerAlgorithm:      aws.String(sseCustomerAlgorithm),
-		SSECustomerKey:            aws.String(sseCustomerKey),
+		SSECustomerKey:            aws.String(sseCustomerKeyEncoded),
+		SSECustomerKeyMD5:         aws.String(sseCustomerKeyMD5),
 		SSEKMSKeyId:               aws.String(sseKmsKeyId),
-		Tagging:                   aws.String(tagging),
+	}
+	if noGuessMimeType && sniffMimeType {
+		return 1, errors.New("Error: --no-guess-mime-type can not be used together with --sniff-mime-type.")
+	}
+	if compressFormat != "" {
+		if !contains(compressionFormats, compressFormat) {
+			return 1, fmt.Errorf("Error: Invalid value for --compress: %s (possible values: %s).", compressFormat, strings.Join(compressionFormats, ", "))
+		}
+		if clientSideEncrypt {
+			return 1, errors.New("Error: --compress can not be used together with --client-side-encrypt.")
+		}
+		if contentEncoding != "" && contentEncoding != compressFormat {
+			return 1, fmt.Errorf("Error: --content-encoding must be %s (or not specified) when using --compress.", compressFormat)
+		}
+		createMultipartUploadInput.ContentEncoding = aws.String(compressFormat)
+	}
+	if splitLarge {
+		if compressFormat != "" || clientSideEncrypt || tarFlag {
+			return 1, errors.New("Error: --split-large can not be used together with --compress, --client-side-encrypt or --tar.")
+		}
+	} else if splitSizeRaw != "" {
+		return 1, errors.New("Error: --split-size requires --split-large.")
+	}
+	if followFlag {
+		if compressFormat != "" || clientSideEncrypt || tarFlag || splitLarge {
+			return 1, errors.New("Error: --follow can not be used together with --compress, --client-side-encrypt, --tar or --split-large.")
+		}
+		if computeChecksum {
+			return 1, errors.New("Error: --follow can not be used together with --compute-checksum.")
+		}
+		if finishByFlag != "" {
+			return 1, errors.New("Error: --follow can not be used together with --finish-by.")
+		}
+		if followQuietPeriod < 0 {
+			return 1, errors.New("Error: --follow-quiet-period must not be negative.")
+		}
+		if followQuietPeriod == 0 && followSentinel == "" {
+			return 1, errors.New("Error: --follow requires --follow-sentinel when --follow-quiet-period is 0.")
+		}
+	} else if followSentinel != "" {
+		return 1, errors.New("Error: --follow-sentinel requires --follow.")
 	}
 	if storageClass != "" {
 		createMultipartUploadInput.StorageClass = s3Types.StorageClass(storageClass)
 		if createMultipartUploadInput.StorageClass == s3Types.StorageClassReducedRedundancy {
-			fmt.Fprintln(os.Stderr, "Warning: REDUCED_REDUNDANCY is not recommended for use. It no longer has any cost benefits over STANDARD.")
-			if dryrun {
-				fmt.Fprintln(os.Stderr)
+			// The warning is shown with --quiet if the user has to confirm
+			var out io.Writer = os.Stderr
+			if dryrun || yes {
+				out = warningOutput()
+			}
+			fmt.Fprintln(out, "Warning: REDUCED_REDUNDANCY is not recommended for use. It no longer has any cost benefits over STANDARD.")
+			if dryrun || yes {
+				fmt.Fprintln(out)
+			} else if !interactive {
+				return 1, errors.New("Error: Use --yes to continue anyway.")
 			} else {
 				fmt.Fprintln(os.Stderr, "Press enter to continue anyway.")
 				fmt.Scanln()
@@ -223,11 +447,18 @@ func run() (int, error) {
 		}
 	}
 	if metadata != "" {
-		if m, err := parseMetadata(metadata); err == nil {
-			createMultipartUploadInput.Metadata = m
-		} else {
-			return 1, fmt.Errorf("Error: %w", err)
+		m, err := parseMetadata(metadata)
+		if err != nil {
+			return 1, fmt.Errorf("Error: Invalid value for --metadata: %w.", err)
 		}
+		createMultipartUploadInput.Metadata = m
+	}
+	if tagging != "" {
+		t, err := parseTagging(tagging)
+		if err != nil {
+			return 1, fmt.Errorf("Error: Invalid value for --tagging: %w.", err)
+		}
+		createMultipartUploadInput.Tagging = aws.String(t)
 	}
 	if objectLockRetainUntilDate != "" {
 		t, err := parseTimestamp(objectLockRetainUntilDate)
@@ -236,6 +467,50 @@ func run() (int, error) {
 		}
 		createMultipartUploadInput.ObjectLockRetainUntilDate = t
 	}
+	if acl != "" {
+		if !contains(knownCannedACLs(), acl) {
+			return 1, fmt.Errorf("Error: Invalid value for --acl: %s (possible values: %s).", acl, strings.Join(knownCannedACLs(), ", "))
+		}
+		if len(grants) > 0 {
+			return 1, errors.New("Error: --acl can not be used together with --grants.")
+		}
+		createMultipartUploadInput.ACL = s3Types.ObjectCannedACL(acl)
+	}
+	if len(grants) > 0 {
+		err := applyGrants(&createMultipartUploadInput, grants)
+		if err != nil {
+			return 1, fmt.Errorf("Error: Invalid value for --grants: %w.", err)
+		}
+	}
+	if expires != "" {
+		t, err := parseTimestamp(expires)
+		if err != nil {
+			return 1, err
+		}
+		createMultipartUploadInput.Expires = t
+	}
+	if websiteRedirect != "" {
+		if !strings.HasPrefix(websiteRedirect, "/") && !strings.HasPrefix(websiteRedirect, "http://") && !strings.HasPrefix(websiteRedirect, "https://") {
+			return 1, errors.New("Error: --website-redirect must start with /, http:// or https://.")
+		}
+		createMultipartUploadInput.WebsiteRedirectLocation = aws.String(websiteRedirect)
+	}
+	if sseKmsEncryptionContext != "" {
+		if sse != string(s3Types.ServerSideEncryptionAwsKms) && sse != string(s3Types.ServerSideEncryptionAwsKmsDsse) {
+			return 1, errors.New("Error: --sse-kms-encryption-context requires --sse aws:kms or aws:kms:dsse.")
+		}
+		encryptionContext, err := parseEncryptionContext(sseKmsEncryptionContext)
+		if err != nil {
+			return 1, fmt.Errorf("Error: Invalid value for --sse-kms-encryption-context: %w.", err)
+		}
+		createMultipartUploadInput.SSEKMSEncryptionContext = aws.String(encryptionContext)
+	}
+	if sseCustomerCopySourceKey != "" && sseCustomerCopySource == "" {
+		return 1, errors.New("Error: --sse-c-copy-source must be specified with --sse-c-copy-source-key.")
+	}
+	if sseCustomerCopySource != "" {
+		fmt.Fprintln(warningOutput(), "Warning: --sse-c-copy-source has no effect since the source is a local file.")
+	}
 
 	var initialRate int64
 	if bwlimit != "" {
@@ -245,10 +520,56 @@ func run() (int, error) {
 			return 1, err
 		}
 	}
+	var burst int64
+	if bwlimitBurst != "" {
+		var err error
+		burst, err = parseFilesize(bwlimitBurst)
+		if err != nil {
+			return 1, err
+		}
+	}
+	var hostRate int64
+	if hostBwlimit != "" {
+		var err error
+		hostRate, err = parseRate(hostBwlimit)
+		if err != nil {
+			return 1, err
+		}
+		if hostRate == 0 {
+			return 1, errors.New("Error: --host-bwlimit can not be unlimited.")
+		}
+		if hostWeight < 1 {
+			return 1, errors.New("Error: --host-weight must be at least 1.")
+		}
+	}
+	var interfaceRate int64
+	if networkInterface != "" || interfaceBwlimit != "" {
+		if networkInterface == "" || interfaceBwlimit == "" {
+			return 1, errors.New("Error: --interface and --interface-bwlimit must be used together.")
+		}
+		var err error
+		interfaceRate, err = parseRate(interfaceBwlimit)
+		if err != nil {
+			return 1, err
+		}
+		if interfaceRate == 0 {
+			return 1, errors.New("Error: --interface-bwlimit can not be unlimited.")
+		}
+		_, err = readInterfaceTxBytes(networkInterface)
+		if err != nil {
+			return 1, fmt.Errorf("Error: %w", err)
+		}
+	}
+	if maxLoad != 0 || maxIOPressure != 0 {
+		_, err := checkHostLoad(maxLoad, maxIOPressure)
+		if err != nil {
+			return 1, fmt.Errorf("Error reading the system load: %w", err)
+		}
+	}
 	var schedule *Schedule
 	if scheduleFn != "" {
 		var err error
-		schedule, err = readSchedule(scheduleFn)
+		schedule, err = loadSchedule(scheduleFn)
 		if err != nil {
 			return 1, fmt.Errorf("Error loading %s: %w", scheduleFn, err)
 		}
@@ -259,6 +580,69 @@ func run() (int, error) {
 		}
 	}
 	rate := initialRate
+	var finishBy *time.Time
+	if finishByFlag != "" {
+		var err error
+		finishBy, err = parseTimestamp(finishByFlag)
+		if err != nil {
+			return 1, fmt.Errorf("Error: Invalid --finish-by: %w", err)
+		}
+		if finishBy.Before(time.Now()) {
+			return 1, errors.New("Error: The --finish-by time has already passed.")
+		}
+	}
+	var startAt, stopAt *time.Time
+	if startAtFlag != "" {
+		var err error
+		startAt, err = parseTimeSpec(startAtFlag, time.Now())
+		if err != nil {
+			return 1, fmt.Errorf("Error: Invalid --start-at: %w", err)
+		}
+	}
+	// The stop time is relative to when the upload starts (e.g. --start-at 22:00 --stop-at 06:00 stops the next morning)
+	uploadStart := time.Now()
+	if startAt != nil && startAt.After(uploadStart) {
+		uploadStart = *startAt
+	}
+	if stopAtFlag != "" && runFor != 0 {
+		return 1, errors.New("Error: --stop-at and --run-for can not be used together.")
+	} else if stopAtFlag != "" {
+		var err error
+		stopAt, err = parseTimeSpec(stopAtFlag, uploadStart)
+		if err != nil {
+			return 1, fmt.Errorf("Error: Invalid --stop-at: %w", err)
+		}
+	} else if runFor > 0 {
+		t := uploadStart.Add(runFor)
+		stopAt = &t
+	}
+	if startAt != nil && stopAt != nil && !stopAt.After(*startAt) {
+		return 1, errors.New("Error: The stop time must be after the start time.")
+	}
+	var quotas []Quota
+	if schedule != nil {
+		quotas = schedule.quotas
+	}
+	if quotaFlag != "" {
+		q, err := parseQuotas(quotaFlag)
+		if err != nil {
+			return 1, fmt.Errorf("Error: %w", err)
+		}
+		quotas = mergeQuotas(quotas, q)
+	}
+	if len(quotas) > 0 && quotaStateFn == "" {
+		configDir, err := defaultConfigDir()
+		if err != nil {
+			return 1, err
+		}
+		quotaStateFn = filepath.Join(configDir, "quota.json")
+	}
+
+	// Read the keyboard controls from the config file
+	keys, err := loadKeymap(configFile)
+	if err != nil {
+		return 1, fmt.Errorf("Error loading %s: %w", configFn, err)
+	}
 
 	// Get the file size
 	// TODO: Check if the file has been modified since the multi part was started and print a warning
@@ -267,10 +651,99 @@ func run() (int, error) {
 		return 1, err
 	}
 	fileSize := stat.Size()
-	fmt.Fprintf(os.Stderr, "File size: %s\n", formatFilesize(fileSize))
-	if fileSize > 5*TiB {
-		fmt.Fprintln(os.Stderr, "Warning: File size is greater than 5 TiB. At the time of writing 5 TiB is the maximum object size on Amazon S3.")
-		fmt.Fprintln(os.Stderr, "This program is not stopping you from proceeding in case the limit has been increased, but be warned!")
+	var device *deviceInfo
+	var archive *tarArchive
+	if tarFlag {
+		if !stat.IsDir() {
+			return 1, fmt.Errorf("Error: %s is not a directory.", file)
+		}
+		if computeChecksum {
+			return 1, errors.New("Error: --compute-checksum can not be used together with --tar.")
+		}
+		fmt.Fprintf(infoOutput(), "Scanning %s...\n", file)
+		archive, err = newTarArchive(file)
+		if err != nil {
+			return 1, fmt.Errorf("Error: %w", err)
+		}
+		defer archive.Close()
+		for _, fn := range archive.skipped {
+			fmt.Fprintf(warningOutput(), "Warning: Skipping %s since it is not a regular file, directory or symlink.\n", fn)
+		}
+		fileSize = archive.size
+		fmt.Fprintf(infoOutput(), "Tar archive: %s\n", archive)
+	} else if stat.IsDir() {
+		return 1, fmt.Errorf("Error: %s is a directory. Use --tar to upload it as a tar archive.", file)
+	} else if isBlockDevice(stat) {
+		device, err = newDeviceInfo(file)
+		if err != nil {
+			return 1, fmt.Errorf("Error getting the size of %s: %w", file, err)
+		}
+		fileSize = device.Size
+		fmt.Fprintf(infoOutput(), "Block device: %s\n", device)
+	}
+	if followFlag {
+		if !stat.Mode().IsRegular() {
+			return 1, fmt.Errorf("Error: %s is not a regular file, it can not be followed.", file)
+		}
+		fmt.Fprintf(infoOutput(), "File size: %s so far (the file is followed as it grows)\n", formatFilesize(fileSize))
+	} else {
+		fmt.Fprintf(infoOutput(), "File size: %s\n", formatFilesize(fileSize))
+	}
+	if contentType != "" {
+		fmt.Fprintf(infoOutput(), "Content-Type: %s\n", contentType)
+	} else if clientSideEncrypt {
+		// The object is not usable without decrypting it, so the type of the file does not apply
+		createMultipartUploadInput.ContentType = aws.String("application/octet-stream")
+		fmt.Fprintln(infoOutput(), "Content-Type: application/octet-stream (encrypted)")
+	} else if archive != nil {
+		createMultipartUploadInput.ContentType = aws.String("application/x-tar")
+		fmt.Fprintln(infoOutput(), "Content-Type: application/x-tar")
+	} else if !noGuessMimeType {
+		t, source, err := guessContentType(file, sniffMimeType)
+		if err != nil {
+			return 1, err
+		}
+		if t != "" {
+			createMultipartUploadInput.ContentType = aws.String(t)
+			fmt.Fprintf(infoOutput(), "Content-Type: %s (%s)\n", t, source)
+		} else {
+			fmt.Fprintln(infoOutput(), "Content-Type: unknown (S3 will use binary/octet-stream)")
+		}
+	}
+	// With client-side encryption, the size of the encrypted data is used from now on
+	var encryption *encryptionParams
+	var dataKey []byte
+	if clientSideEncrypt {
+		encryption, dataKey, err = newEncryptionParams(cseSecret, fileSize)
+		if err != nil {
+			return 1, fmt.Errorf("Error: %w", err)
+		}
+		fileSize = encryption.encryptedSize()
+		fmt.Fprintf(infoOutput(), "Client-side encryption: %s\n", encryption)
+		fmt.Fprintf(infoOutput(), "Encrypted size: %s\n", formatFilesize(fileSize))
+	}
+	if fileSize > maxObjectSize && !splitLarge {
+		fmt.Fprintln(warningOutput(), "Warning: File size is greater than 5 TiB. At the time of writing 5 TiB is the maximum object size on Amazon S3. Use --split-large to upload it as several objects.")
+		fmt.Fprintln(warningOutput(), "This program is not stopping you from proceeding in case the limit has been increased, but be warned!")
+	}
+	// With --split-large, the part size is based on the size of the chunks
+	var splitSize int64
+	if splitSizeRaw != "" {
+		var err error
+		splitSize, err = parseFilesize(splitSizeRaw)
+		if err != nil {
+			return 1, err
+		}
+		if splitSize <= 0 {
+			return 1, errors.New("Error: --split-size must be greater than zero.")
+		}
+	}
+	uploadSize := fileSize
+	if splitLarge {
+		uploadSize = min(fileSize, maxObjectSize)
+		if splitSize != 0 {
+			uploadSize = min(fileSize, splitSize)
+		}
 	}
 
 	var partSize int64 = 8 * MiB
@@ -287,23 +760,48 @@ func run() (int, error) {
 		// The maximum part size is 5 GiB, which would in theory allow 50000 GiB (~48.8 TiB) in 10,000 parts.
 		// The aws cli follows a very similar algorithm: https://github.com/boto/s3transfer/blob/0.5.0/s3transfer/utils.py#L711-L763
 		// var partSize int64 = 8 * MiB
-		for 10000*partSize < fileSize {
+		for 10000*partSize < uploadSize {
 			partSize *= 2
 		}
 		if partSize > 5*GiB {
 			partSize = 5 * GiB
 		}
 	}
-	fmt.Fprintf(os.Stderr, "Part size: %s\n", formatFilesize(partSize))
+	fmt.Fprintf(infoOutput(), "Part size: %s\n", formatFilesize(partSize))
 	if partSize < 5*MiB || partSize > 5*GiB {
-		fmt.Fprintln(os.Stderr, "Warning: Part size is not in the allowed limits (must be between 5 MiB to 5 GiB).")
-		fmt.Fprintln(os.Stderr, "This program is not stopping you from proceeding in case the limits have changed, but be warned!")
+		fmt.Fprintln(warningOutput(), "Warning: Part size is not in the allowed limits (must be between 5 MiB to 5 GiB).")
+		fmt.Fprintln(warningOutput(), "This program is not stopping you from proceeding in case the limits have changed, but be warned!")
+	}
+	if compressFormat != "" {
+		fmt.Fprintf(infoOutput(), "Compression: %s\n", compressFormat)
+		fmt.Fprintf(infoOutput(), "The upload will consist of up to %d parts, depending on how well the file compresses.\n", int64(math.Ceil(float64(fileSize)/float64(partSize))))
+	} else if followFlag {
+		// The final size is not known, so the part size is based on the current size unless --part-size is used
+		fmt.Fprintf(infoOutput(), "The file can grow to %s with this part size (10,000 parts). Use --part-size if it may grow larger.\n", formatFilesize(10000*partSize))
+	} else {
+		fmt.Fprintf(infoOutput(), "The upload will consist of %d parts.\n", int64(math.Ceil(float64(fileSize)/float64(partSize))))
+	}
+	var split *splitPlan
+	if splitLarge {
+		if splitSize == 0 {
+			splitSize = min(maxObjectSize, 10000*partSize) / partSize * partSize
+		} else if splitSize%partSize != 0 {
+			return 1, fmt.Errorf("Error: --split-size must be a multiple of the part size (%s).", formatFilesize(partSize))
+		}
+		if fileSize > splitSize {
+			split = newSplitPlan(key, fileSize, stat.ModTime(), splitSize)
+			fmt.Fprintf(infoOutput(), "The file will be split into %d objects of %s (%s to %s).\n", split.count, formatFilesize(splitSize), split.chunkKey(0), split.chunkKey(split.count-1))
+		}
 	}
-	fmt.Fprintf(os.Stderr, "The upload will consist of %d parts.\n", int64(math.Ceil(float64(fileSize)/float64(partSize))))
-	if 10000*partSize < fileSize {
-		fmt.Fprintln(os.Stderr, "Warning: File size is too large to be transferred in 10,000 parts!")
+	for _, q := range quotas {
+		if q.limit < partSize {
+			return 1, fmt.Errorf("Error: The quota %s is smaller than the part size.", q)
+		}
+	}
+	if 10000*partSize < uploadSize {
+		fmt.Fprintln(warningOutput(), "Warning: File size is too large to be transferred in 10,000 parts!")
 	}
-	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(infoOutput())
 
 	// Open the file
 	f, err := os.Open(file)
@@ -311,17 +809,32 @@ func run() (int, error) {
 		return 1, err
 	}
 	defer f.Close()
+	// The data that is uploaded, before it is compressed or encrypted
+	var input io.ReaderAt = f
+	if archive != nil {
+		input = archive
+	}
+	var follower *fileFollower
+	if followFlag {
+		follower, err = newFileFollower(f, followQuietPeriod, followSentinel)
+		if err != nil {
+			return 1, err
+		}
+		fileSize = follower.size
+	}
 
 	// Look for a SHA256SUMS file and get this file's hash
+	var fileSha256 string // With --split-large, the checksum of the whole file is stored in the manifest
 	if !dryrun {
 		_, err = os.Stat("SHA256SUMS")
-		if !errors.Is(err, fs.ErrNotExist) {
+		// The checksum of a file that is still being written is not known yet
+		if !errors.Is(err, fs.ErrNotExist) && archive == nil && follower == nil {
 			sum, err := lookupChecksum("SHA256SUMS", file)
 			if err != nil {
 				return 1, fmt.Errorf("Error: %w", err)
 			} else if sum == "" {
 				if !computeChecksum {
-					fmt.Fprintln(os.Stderr, "Warning: SHA256SUMS file is present but does not have an entry for this file. Consider using --compute-checksum.")
+					fmt.Fprintln(warningOutput(), "Warning: SHA256SUMS file is present but does not have an entry for this file. Consider using --compute-checksum.")
 				}
 			} else {
 				if createMultipartUploadInput.Metadata == nil {
@@ -331,7 +844,7 @@ func run() (int, error) {
 			}
 		}
 		if computeChecksum && createMultipartUploadInput.Metadata["sha256sum"] == "" {
-			fmt.Fprint(os.Stderr, "Computing SHA256 checksum... ")
+			fmt.Fprint(infoOutput(), "Computing SHA256 checksum... ")
 			sum, err := computeSha256Sum(file)
 			if err != nil {
 				return 1, err
@@ -340,8 +853,8 @@ func run() (int, error) {
 				createMultipartUploadInput.Metadata = make(map[string]string)
 			}
 			createMultipartUploadInput.Metadata["sha256sum"] = sum
-			fmt.Fprintln(os.Stderr, sum)
-			fmt.Fprintln(os.Stderr, "Adding checksum to SHA256SUMS...")
+			fmt.Fprintln(infoOutput(), sum)
+			fmt.Fprintln(infoOutput(), "Adding checksum to SHA256SUMS...")
 			sumsFile, err := os.OpenFile("SHA256SUMS", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 			if err != nil {
 				return 1, fmt.Errorf("Error adding checksum to SHA256SUMS: %w", err)
@@ -353,128 +866,42 @@ func run() (int, error) {
 				return 1, fmt.Errorf("Error adding checksum to SHA256SUMS: %w", err)
 			}
 		}
+		// The checksum is of the uncompressed file, so it does not match the object
+		if sum, ok := createMultipartUploadInput.Metadata["sha256sum"]; ok && compressFormat != "" {
+			delete(createMultipartUploadInput.Metadata, "sha256sum")
+			createMultipartUploadInput.Metadata["uncompressed-sha256sum"] = sum
+		}
+		if sum, ok := createMultipartUploadInput.Metadata["sha256sum"]; ok && split != nil {
+			delete(createMultipartUploadInput.Metadata, "sha256sum")
+			fileSha256 = sum
+		}
+		// The checksum counts towards the metadata size limit
+		if len(createMultipartUploadInput.Metadata) > 0 && metadata != "" {
+			err = validateMetadata(createMultipartUploadInput.Metadata)
+			if err != nil {
+				return 1, fmt.Errorf("Error: Invalid value for --metadata: %w.", err)
+			}
+		}
 	}
 
 	// Initialize the AWS SDK
-	var promptingForMfa bool
-	var mfaReader io.Reader = os.Stdin
+	mfa := &mfaPrompt{reader: os.Stdin}
 	var mfaWriter io.Writer
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		func(o *config.LoadOptions) error {
-			if profile != "" {
-				o.SharedConfigProfile = profile
-			}
-			if caBundle != "" {
-				f, err := os.Open(caBundle)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					os.Exit(1)
-				}
-				o.CustomCABundle = f
-			}
-			if noVerifySsl {
-				o.HTTPClient = &http.Client{
-					Transport: &http.Transport{
-						TLSClientConfig: &tls.Config{
-							InsecureSkipVerify: true,
-						},
-					},
-				}
-			}
-			if debug {
-				var lm aws.ClientLogMode = aws.LogRequest | aws.LogResponse
-				o.ClientLogMode = &lm
-			}
-			return nil
-		},
-		config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
-			o.Duration = mfaDuration
-			o.TokenProvider = func() (string, error) {
-				if mfaSecret == nil {
-					promptingForMfa = true
-					for {
-						fmt.Fprint(os.Stderr, "Assume Role MFA token code: ")
-						var code string
-						_, err = fmt.Fscanln(mfaReader, &code)
-						if len(code) == 6 && isNumeric(code) {
-							promptingForMfa = false
-							return code, err
-						}
-						fmt.Fprintln(os.Stderr, "Code must consist of 6 digits. Please try again.")
-					}
-				} else {
-					t := time.Now().UTC()
-					period := 30
-					counter := uint64(math.Floor(float64(t.Unix()) / float64(period)))
-					code, err := generateOTP(mfaSecret, counter, sha1.New, 6)
-					if debug {
-						fmt.Fprintf(os.Stderr, "Generated TOTP code: %s\n", code)
-					}
-					if err != nil {
-						fmt.Fprintln(os.Stderr, err)
-					}
-					return code, err
-				}
-			}
-		}),
-	)
+	client, err := newS3Client(bucket, clientOpts, mfa)
 	if err != nil {
 		return 1, err
 	}
-	client := s3.NewFromConfig(cfg,
-		func(o *s3.Options) {
-			o.EndpointOptions.UseDualStackEndpoint = useDualStackEndpoint
-			if noSignRequest {
-				o.Credentials = aws.AnonymousCredentials{}
-			}
-			if region != "" {
-				o.Region = region
-			}
-			if endpointURL != "" {
-				o.BaseEndpoint = aws.String(endpointURL)
-			}
-			if usePathStyle {
-				o.UsePathStyle = true
-			}
-			if useAccelerateEndpoint {
-				o.UseAccelerate = true
-			}
-		})
 	encryptedEndpoint := (endpointURL == "" || strings.HasPrefix(endpointURL, "https://"))
 
-	// Get the bucket location
-	if endpointURL == "" && region == "" {
-		bucketLocationOutput, err := client.GetBucketLocation(context.TODO(), &s3.GetBucketLocationInput{
-			Bucket: aws.String(bucket),
-		})
-		if err != nil {
-			return 1, err
-		}
-		bucketRegion := normalizeBucketLocation(bucketLocationOutput.LocationConstraint)
-		if debug {
-			fmt.Fprintf(os.Stderr, "Bucket region: %s\n", bucketRegion)
-		}
-		client = s3.NewFromConfig(cfg, func(o *s3.Options) {
-			o.EndpointOptions.UseDualStackEndpoint = useDualStackEndpoint
-			if noSignRequest {
-				o.Credentials = aws.AnonymousCredentials{}
-			}
-			o.Region = bucketRegion
-			if usePathStyle {
-				o.UsePathStyle = true
-			}
-			if useAccelerateEndpoint {
-				o.UseAccelerate = true
-			}
-		})
-	}
-
-	// Abort if the object already exists
+	// Abort if the object already exists (with --split-large, the manifest is written when all the chunks have been uploaded)
 	if !force {
+		existingKey := key
+		if split != nil {
+			existingKey = key + manifestSuffix
+		}
 		obj, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
 			Bucket:       aws.String(bucket),
-			Key:          aws.String(key),
+			Key:          aws.String(existingKey),
 			RequestPayer: s3Types.RequestPayer(requestPayer),
 		})
 		if obj != nil || err == nil || !isSmithyErrorCode(err, 404) {
@@ -486,61 +913,288 @@ func run() (int, error) {
 		}
 	}
 
-	// Check if we should resume an upload
-	fmt.Fprintln(os.Stderr, "Checking if this upload is already in progress.")
-	var uploadId string
-	paginatorListMultipartUploads := s3.NewListMultipartUploadsPaginator(client, &s3.ListMultipartUploadsInput{
-		Bucket:       aws.String(bucket),
-		RequestPayer: s3Types.RequestPayer(requestPayer),
-	})
-	for paginatorListMultipartUploads.HasMorePages() {
-		page, err := paginatorListMultipartUploads.NextPage(context.TODO())
-		if err != nil {
-			return 1, err
-		}
-		for _, upload := range page.Uploads {
-			if aws.ToString(upload.Key) != key {
-				continue
-			}
-
-			// fmt.Fprintf(os.Stderr, "Upload: {Key: %s, Initiated: %s, Initiator: {%s %s}, Owner: {%s %s}, StorageClass: %s, UploadId: %s}\n", aws.ToString(upload.Key), upload.Initiated, aws.ToString(upload.Initiator.DisplayName), aws.ToString(upload.Initiator.ID), aws.ToString(upload.Owner.DisplayName), aws.ToString(upload.Owner.ID), upload.StorageClass, aws.ToString(upload.UploadId))
-			if uploadId != "" {
-				return 1, errors.New("Error: More than one upload for this key is in progress. Please manually abort duplicated multipart uploads.")
-			}
-			uploadId = aws.ToString(upload.UploadId)
-			fmt.Fprintf(os.Stderr, "Found an upload in progress with upload id: %s\n", uploadId)
-
-			localLocation, err := time.LoadLocation("Local")
-			if err != nil {
-				return 1, err
+	// Wait for the start time
+	if startAt != nil && time.Now().Before(*startAt) {
+		if dryrun {
+			fmt.Fprintf(infoOutput(), "The upload will start at %s.\n", formatTime(*startAt))
+		} else {
+			fmt.Fprintf(infoOutput(), "Waiting until %s to start the upload.\n", formatTime(*startAt))
+			for time.Now().Before(*startAt) {
+				time.Sleep(minDuration(time.Minute, time.Until(*startAt)))
 			}
-			fmt.Fprintf(os.Stderr, "Upload started at %v.\n", upload.Initiated.In(localLocation))
+		}
+	}
 
-			if createMultipartUploadInput.StorageClass != "" &&
-				upload.StorageClass != createMultipartUploadInput.StorageClass {
-				return 1, fmt.Errorf("Error: Existing upload uses the storage class %s. You requested %s. Either make them match or remove --storage-class.\n", upload.StorageClass, createMultipartUploadInput.StorageClass)
-			}
+	// The manifests are stored with the same settings as the object
+	newManifestInput := func(manifestKey string, manifest []byte) *s3.PutObjectInput {
+		return &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(manifestKey),
+			Body:                 bytes.NewReader(manifest),
+			BucketKeyEnabled:     aws.Bool(bucketKeyEnabled),
+			ContentType:          aws.String("application/json"),
+			ExpectedBucketOwner:  aws.String(expectedBucketOwner),
+			RequestPayer:         s3Types.RequestPayer(requestPayer),
+			ServerSideEncryption: s3Types.ServerSideEncryption(sse),
+			SSECustomerAlgorithm: aws.String(sseCustomerAlgorithm),
+			SSECustomerKey:       aws.String(sseCustomerKeyEncoded),
+			SSECustomerKeyMD5:    aws.String(sseCustomerKeyMD5),
+			SSEKMSKeyId:          aws.String(sseKmsKeyId),
+			StorageClass:         createMultipartUploadInput.StorageClass,
+		}
+	}
+
+	// With --split-large, the chunks are uploaded one after another and the upload continues with the first chunk that does not exist yet
+	chunkIndex := 0
+	chunkStart, chunkEnd := int64(0), fileSize
+	var prepareChunk func() error
+	var writeSplitManifest func() error
+	if split != nil {
+		headChunk := func(i int) (*s3.HeadObjectOutput, error) {
+			return client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+				Bucket:               aws.String(bucket),
+				Key:                  aws.String(split.chunkKey(i)),
+				ExpectedBucketOwner:  aws.String(expectedBucketOwner),
+				RequestPayer:         s3Types.RequestPayer(requestPayer),
+				SSECustomerAlgorithm: aws.String(sseCustomerAlgorithm),
+				SSECustomerKey:       aws.String(sseCustomerKeyEncoded),
+				SSECustomerKeyMD5:    aws.String(sseCustomerKeyMD5),
+			})
+		}
+		// Every chunk has its own checksum and position in the metadata
+		metadata := createMultipartUploadInput.Metadata
+		prepareChunk = func() error {
+			m := split.chunkMetadata(chunkIndex)
+			for k, v := range metadata {
+				m[k] = v
+			}
+			fmt.Fprintf(infoOutput(), "Computing SHA256 checksum of %s... ", key)
+			sum, err := computeSha256SumReader(io.NewSectionReader(input, chunkStart, chunkEnd-chunkStart))
+			if err != nil {
+				fmt.Fprintln(infoOutput())
+				return err
+			}
+			fmt.Fprintln(infoOutput(), sum)
+			m["sha256sum"] = sum
+			err = validateMetadata(m)
+			if err != nil {
+				return fmt.Errorf("Invalid value for --metadata: %w", err)
+			}
+			createMultipartUploadInput.Key = aws.String(key)
+			createMultipartUploadInput.Metadata = m
+			return nil
+		}
+		writeSplitManifest = func() error {
+			chunks := make([]*s3.HeadObjectOutput, split.count)
+			for i := range chunks {
+				obj, err := headChunk(i)
+				if err != nil {
+					return fmt.Errorf("%s: %w", split.chunkKey(i), err)
+				}
+				chunks[i] = obj
+			}
+			manifest, err := split.manifest(chunks, fileSha256)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(infoOutput(), "Uploading the manifest to s3://%s/%s\n", bucket, split.key+manifestSuffix)
+			_, err = client.PutObject(context.TODO(), newManifestInput(split.key+manifestSuffix, manifest))
+			return err
+		}
+
+		for ; chunkIndex < split.count; chunkIndex++ {
+			obj, err := headChunk(chunkIndex)
+			if isSmithyErrorCode(err, 404) {
+				break
+			} else if err != nil {
+				return 1, err
+			}
+			if !split.isChunk(chunkIndex, obj) {
+				if !force {
+					return 1, fmt.Errorf("Error: s3://%s/%s already exists and is not a chunk of this file. Please delete it or use --force to overwrite it.", bucket, split.chunkKey(chunkIndex))
+				}
+				break
+			}
+			fmt.Fprintf(infoOutput(), "Chunk %d of %d has already been uploaded (%s).\n", chunkIndex+1, split.count, split.chunkKey(chunkIndex))
+		}
+		if chunkIndex == split.count {
+			if dryrun {
+				fmt.Fprintln(infoOutput(), "All the chunks have been uploaded.")
+				return 0, nil
+			}
+			err = writeSplitManifest()
+			if err != nil {
+				return 1, fmt.Errorf("Error uploading the manifest: %w", err)
+			}
+			fmt.Fprintln(infoOutput(), "All done!")
+			return 0, nil
+		}
+		key = split.chunkKey(chunkIndex)
+		chunkStart, chunkEnd = split.chunkRange(chunkIndex)
+		fmt.Fprintf(infoOutput(), "Uploading chunk %d of %d (s3://%s/%s).\n", chunkIndex+1, split.count, bucket, key)
+	}
+
+	// Check if we should resume an upload
+	fmt.Fprintln(infoOutput(), "Checking if this upload is already in progress.")
+	var uploadId string
+	paginatorListMultipartUploads := s3.NewListMultipartUploadsPaginator(client, &s3.ListMultipartUploadsInput{
+		Bucket:       aws.String(bucket),
+		RequestPayer: s3Types.RequestPayer(requestPayer),
+	})
+	for paginatorListMultipartUploads.HasMorePages() {
+		page, err := paginatorListMultipartUploads.NextPage(context.TODO())
+		if err != nil {
+			return 1, err
+		}
+		for _, upload := range page.Uploads {
+			if aws.ToString(upload.Key) != key {
+				continue
+			}
+
+			// fmt.Fprintf(os.Stderr, "Upload: {Key: %s, Initiated: %s, Initiator: {%s %s}, Owner: {%s %s}, StorageClass: %s, UploadId: %s}\n", aws.ToString(upload.Key), upload.Initiated, aws.ToString(upload.Initiator.DisplayName), aws.ToString(upload.Initiator.ID), aws.ToString(upload.Owner.DisplayName), aws.ToString(upload.Owner.ID), upload.StorageClass, aws.ToString(upload.UploadId))
+			if uploadId != "" {
+				return 1, errors.New("Error: More than one upload for this key is in progress. Please manually abort duplicated multipart uploads.")
+			}
+			uploadId = aws.ToString(upload.UploadId)
+			fmt.Fprintf(infoOutput(), "Found an upload in progress with upload id: %s\n", uploadId)
+
+			localLocation, err := time.LoadLocation("Local")
+			if err != nil {
+				return 1, err
+			}
+			fmt.Fprintf(infoOutput(), "Upload started at %v.\n", upload.Initiated.In(localLocation))
+
+			if createMultipartUploadInput.StorageClass != "" &&
+				upload.StorageClass != createMultipartUploadInput.StorageClass {
+				return 1, fmt.Errorf("Error: Existing upload uses the storage class %s. You requested %s. Either make them match or remove --storage-class.\n", upload.StorageClass, createMultipartUploadInput.StorageClass)
+			}
 		}
 	}
 
 	// Create the multipart upload or get the part information from an existing upload
 	parts := []s3Types.CompletedPart{}
 	var partNumber int32 = 1
-	var offset int64
+	offset := chunkStart
+	var state *uploadState
 	if uploadId == "" {
 		if dryrun {
-			fmt.Fprintln(os.Stderr, "Upload not started.")
+			fmt.Fprintln(infoOutput(), "Upload not started.")
 		} else {
-			fmt.Fprintln(os.Stderr, "Creating multipart upload.")
+			if encryption != nil {
+				if createMultipartUploadInput.Metadata == nil {
+					createMultipartUploadInput.Metadata = make(map[string]string)
+				}
+				createMultipartUploadInput.Metadata[encryptionMetadataKey] = encryption.metadataValue()
+				err = validateMetadata(createMultipartUploadInput.Metadata)
+				if err != nil {
+					return 1, fmt.Errorf("Error: Invalid value for --metadata: %w.", err)
+				}
+			}
+			// The files later in a tar archive may change before the upload is completed, so the manifest is used for that instead
+			if compressFormat != "" && archive == nil {
+				if createMultipartUploadInput.Metadata == nil {
+					createMultipartUploadInput.Metadata = make(map[string]string)
+				}
+				if createMultipartUploadInput.Metadata["uncompressed-sha256sum"] == "" {
+					fmt.Fprint(infoOutput(), "Computing SHA256 checksum of the uncompressed file... ")
+					sum, err := computeSha256SumReader(io.NewSectionReader(input, 0, fileSize))
+					if err != nil {
+						return 1, err
+					}
+					fmt.Fprintln(infoOutput(), sum)
+					createMultipartUploadInput.Metadata["uncompressed-sha256sum"] = sum
+				}
+				createMultipartUploadInput.Metadata["uncompressed-size"] = fmt.Sprint(fileSize)
+				err = validateMetadata(createMultipartUploadInput.Metadata)
+				if err != nil {
+					return 1, fmt.Errorf("Error: Invalid value for --metadata: %w.", err)
+				}
+			}
+			if split != nil {
+				err = prepareChunk()
+				if err != nil {
+					return 1, fmt.Errorf("Error: %w", err)
+				}
+			}
+			fmt.Fprintln(infoOutput(), "Creating multipart upload.")
 			outputCreateMultipartUpload, err := client.CreateMultipartUpload(context.TODO(), &createMultipartUploadInput)
 			if err != nil {
 				return 1, err
 			}
 
 			uploadId = aws.ToString(outputCreateMultipartUpload.UploadId)
-			fmt.Fprintf(os.Stderr, "Upload id: %v\n", uploadId)
+			fmt.Fprintf(infoOutput(), "Upload id: %v\n", uploadId)
+
+			if encryption != nil || compressFormat != "" || device != nil || archive != nil {
+				absFile, err := filepath.Abs(file)
+				if err != nil {
+					return 1, err
+				}
+				state = &uploadState{
+					Bucket:     bucket,
+					Key:        key,
+					UploadId:   uploadId,
+					File:       absFile,
+					Device:     device,
+					Encryption: encryption,
+				}
+				if compressFormat != "" {
+					state.Compression = &compressionState{Format: compressFormat}
+				}
+				if archive != nil {
+					state.Tar = &tarState{}
+				}
+				err = writeUploadState(state)
+				if err != nil {
+					return 1, fmt.Errorf("Error saving the upload state (the upload can not be resumed without it): %w", err)
+				}
+			}
 		}
 	} else {
+		// The encryption parameters and where the compressed parts start are needed to continue the upload
+		state, err = readUploadState(bucket, key, uploadId)
+		if err != nil {
+			return 1, fmt.Errorf("Error reading the upload state: %w", err)
+		}
+		if state != nil && state.Compression != nil && compressFormat != state.Compression.Format {
+			return 1, fmt.Errorf("Error: The upload in progress was started with --compress=%s.", state.Compression.Format)
+		} else if compressFormat != "" && (state == nil || state.Compression == nil) {
+			return 1, errors.New("Error: The upload in progress was not started with --compress, or its state file is missing. Abort the upload to start over.")
+		}
+		if state != nil && state.Tar != nil && archive == nil {
+			return 1, errors.New("Error: The upload in progress was started with --tar.")
+		} else if archive != nil && (state == nil || state.Tar == nil) {
+			return 1, errors.New("Error: The upload in progress was not started with --tar, or its state file is missing. Abort the upload to start over.")
+		}
+		if device != nil {
+			if state == nil || state.Device == nil {
+				fmt.Fprintln(warningOutput(), "Warning: Unable to verify that this is the same device that the upload was started with.")
+			} else if err := device.sameDevice(state.Device); err != nil {
+				return 1, fmt.Errorf("Error: Can not resume the upload: %w.", err)
+			}
+		}
+		if state != nil && state.Encryption != nil && encryption == nil {
+			return 1, errors.New("Error: The upload in progress was started with --client-side-encrypt.")
+		} else if encryption != nil {
+			if state == nil || state.Encryption == nil {
+				return 1, errors.New("Error: The upload in progress was not started with --client-side-encrypt, or its state file is missing. Abort the upload to start over.")
+			}
+			if state.Encryption.Size != encryption.Size {
+				if archive != nil {
+					return 1, fmt.Errorf("Error: The size of the tar archive has changed since the upload was started (%d bytes, now %d bytes). An encrypted archive can only be resumed if no files have been added, removed or resized. Abort the upload to start over.", state.Encryption.Size, encryption.Size)
+				}
+				return 1, fmt.Errorf("Error: The file size has changed since the upload was started (%d bytes, now %d bytes).", state.Encryption.Size, encryption.Size)
+			}
+			dataKey, err = state.Encryption.unwrapKey(cseSecret)
+			if err != nil {
+				return 1, fmt.Errorf("Error: Can not resume the upload: %w.", err)
+			}
+			encryption = state.Encryption
+			if encryption.encryptedSize() != fileSize {
+				return 1, errors.New("Error: The encryption parameters of the upload in progress are not supported.")
+			}
+		}
+
 		paginatorListParts := s3.NewListPartsPaginator(client, &s3.ListPartsInput{
 			Bucket:       aws.String(bucket),
 			Key:          aws.String(key),
@@ -548,6 +1202,7 @@ func run() (int, error) {
 			RequestPayer: s3Types.RequestPayer(requestPayer),
 		})
 		var part1Size int64
+		var partSizes []int64
 		for paginatorListParts.HasMorePages() {
 			page, err := paginatorListParts.NextPage(context.TODO())
 			if err != nil {
@@ -556,14 +1211,18 @@ func run() (int, error) {
 			if part1Size == 0 && len(page.Parts) > 0 {
 				part1Size = aws.ToInt64(page.Parts[0].Size)
 			}
-			partNumber += int32(len(page.Parts))
 			for _, part := range page.Parts {
 				if debug {
 					fmt.Fprintf(os.Stderr, "Part: %s\n", string(jsonMustMarshal(part)))
 				}
+				// An empty part is left behind if shrimp exited right after verifying the SSE-C key (see below), it is overwritten by the next part
+				if aws.ToInt64(part.Size) == 0 {
+					continue
+				}
 				partNumber := aws.ToInt32(part.PartNumber)
 				partSize := aws.ToInt64(part.Size)
 				offset += partSize
+				partSizes = append(partSizes, partSize)
 				parts = append(parts, s3Types.CompletedPart{
 					PartNumber:     part.PartNumber,
 					ETag:           part.ETag,
@@ -573,16 +1232,17 @@ func run() (int, error) {
 					ChecksumSHA256: part.ChecksumSHA256,
 				})
 				// Check for potential problems (if not the last part)
-				if offset != fileSize {
+				if offset != chunkEnd && compressFormat == "" {
 					if partSize < 5*MiB {
-						fmt.Fprintf(os.Stderr, "Warning: Part %d has size %s, which is less than 5 MiB, and it is not the last part in the upload. This upload will fail with an error!\n", partNumber, formatFilesize(partSize))
+						fmt.Fprintf(warningOutput(), "Warning: Part %d has size %s, which is less than 5 MiB, and it is not the last part in the upload. This upload will fail with an error!\n", partNumber, formatFilesize(partSize))
 					} else if partSize != part1Size {
-						fmt.Fprintf(os.Stderr, "Warning: Part %d has an inconsistent size (%d bytes) compared to part 1 (%d bytes).\n", partNumber, partSize, part1Size)
+						fmt.Fprintf(warningOutput(), "Warning: Part %d has an inconsistent size (%d bytes) compared to part 1 (%d bytes).\n", partNumber, partSize, part1Size)
 					}
 				}
 			}
 		}
-		fmt.Fprintf(os.Stderr, "%s already uploaded in %d parts.\n", formatFilesize(offset), len(parts))
+		partNumber = int32(len(parts)) + 1
+		fmt.Fprintf(infoOutput(), "%s already uploaded in %d parts.\n", formatFilesize(offset-chunkStart), len(parts))
 
 		// Check if there are any gaps in the existing parts
 		partNumbers := make([]int, len(parts))
@@ -596,69 +1256,427 @@ func run() (int, error) {
 			}
 		}
 
-		if offset > fileSize {
+		// Continue compressing the file where the last part ended
+		if compressFormat != "" {
+			if len(parts) > len(state.Compression.Parts) {
+				return 1, fmt.Errorf("Error: The upload state only has information about %d parts, but %d parts have been uploaded.", len(state.Compression.Parts), len(parts))
+			}
+			var rawOffset int64
+			for i, size := range partSizes {
+				part := state.Compression.Parts[i]
+				if part.Size != size || part.RawOffset != rawOffset {
+					return 1, fmt.Errorf("Error: Part %d does not match the upload state.", i+1)
+				}
+				rawOffset += part.RawSize
+			}
+			state.Compression.Parts = state.Compression.Parts[:len(parts)]
+			offset = rawOffset
+		}
+
+		// Continue the archive where the last part ended, if the files before that point are the same
+		if archive != nil {
+			if len(parts) > len(state.Tar.Parts) {
+				return 1, fmt.Errorf("Error: The upload state only has information about %d parts, but %d parts have been uploaded.", len(state.Tar.Parts), len(parts))
+			}
+			state.Tar.Parts = state.Tar.Parts[:len(parts)]
+			if len(parts) > 0 {
+				last := state.Tar.Parts[len(parts)-1]
+				err = archive.resumeAt(last)
+				if err != nil {
+					return 1, fmt.Errorf("Error: The directory has changed since the upload was started (%v). Abort the upload to start over.", err)
+				}
+				fmt.Fprintf(infoOutput(), "Continuing the archive after %d of %d entries.\n", last.Entries, len(archive.entries))
+			}
+		}
+
+		if offset > chunkEnd {
 			return 1, errors.New("Error: Size of parts already uploaded is greater than local file size.")
 		}
-		fmt.Fprintf(os.Stderr, "%s remaining.\n", formatFilesize(fileSize-offset))
+		fmt.Fprintf(infoOutput(), "%s remaining.\n", formatFilesize(fileSize-offset))
+
+		// Make sure that the SSE-C key is the same as the one that was used to start the upload, by uploading an empty part that is overwritten by the next part
+		if sseCustomerAlgorithm != "" && !dryrun {
+			fmt.Fprintln(infoOutput(), "Verifying the SSE-C key.")
+			_, err := client.UploadPart(context.TODO(), &s3.UploadPartInput{
+				Bucket:               aws.String(bucket),
+				Key:                  aws.String(key),
+				UploadId:             aws.String(uploadId),
+				PartNumber:           aws.Int32(partNumber),
+				Body:                 bytes.NewReader(nil),
+				ChecksumAlgorithm:    s3Types.ChecksumAlgorithm(checksumAlgorithm),
+				ExpectedBucketOwner:  aws.String(expectedBucketOwner),
+				RequestPayer:         s3Types.RequestPayer(requestPayer),
+				SSECustomerAlgorithm: aws.String(sseCustomerAlgorithm),
+				SSECustomerKey:       aws.String(sseCustomerKeyEncoded),
+				SSECustomerKeyMD5:    aws.String(sseCustomerKeyMD5),
+			})
+			if err != nil {
+				// These are the errors that S3 returns when the encryption parameters do not match the upload, other errors are unrelated to the key
+				if isAPIErrorCode(err, "InvalidArgument", "InvalidRequest", "InvalidEncryptionAlgorithmError") {
+					return 1, fmt.Errorf("Error: The SSE-C key does not match the key that was used to start the upload: %w", err)
+				}
+				return 1, err
+			}
+		}
+	}
+
+	// The data that is uploaded
+	source := input
+	if encryption != nil {
+		source, err = newEncryptingReaderAt(input, encryption, dataKey)
+		if err != nil {
+			return 1, err
+		}
+	}
+	var comp *compressor
+	var compressedOffset int64 // The compressed size of the parts that have been uploaded
+	if compressFormat != "" {
+		comp, err = newCompressor(compressFormat, input, fileSize)
+		if err != nil {
+			return 1, fmt.Errorf("Error: %w", err)
+		}
+		defer comp.Close()
+		if state != nil {
+			for _, part := range state.Compression.Parts {
+				compressedOffset += part.Size
+			}
+		}
 	}
 
 	if dryrun {
-		if rate != 0 {
-			bytesRemaining := fileSize - offset
+		bytesRemaining := fileSize - offset
+		if schedule != nil {
+			now := time.Now()
+			scheduledRate, _ := schedule.rateAt(now)
+			// Unlimited periods are estimated using the configured rate, since there is no measured rate yet
+			if scheduledRate == 0 {
+				scheduledRate = rate
+			}
+			completion, ok := estimateCompletion(bytesRemaining, scheduledRate, rate, schedule, now)
+			if ok {
+				fmt.Fprintf(infoOutput(), "\nFollowing the schedule, the upload will complete at %s (in %s).\n", formatTime(completion), completion.Sub(now).Round(time.Second))
+			} else {
+				fmt.Fprintln(infoOutput(), "\nUnable to estimate when the upload will complete since the schedule has unlimited periods. Use --bwlimit to estimate them with a transfer rate.")
+			}
+		} else if rate != 0 {
 			ns := float64(bytesRemaining) / float64(rate) * 1e9
 			timeRemaining := time.Duration(ns).Round(time.Second)
-			fmt.Fprintf(os.Stderr, "\nCompleting the upload at %s/s will take %s.\n", formatSize(rate), timeRemaining)
+			fmt.Fprintf(infoOutput(), "\nCompleting the upload at %s/s will take %s.\n", formatSize(rate), timeRemaining)
+		}
+		if finishBy != nil {
+			if requiredRate, ok := deadlineRate(bytesRemaining, *finishBy, schedule, time.Now()); ok {
+				fmt.Fprintf(infoOutput(), "Completing the upload by %s requires a transfer rate of %s/s (including a safety margin).\n", formatTime(*finishBy), formatSize(requiredRate))
+			} else {
+				fmt.Fprintf(warningOutput(), "Warning: The upload can not be completed by %s under the current schedule.\n", formatTime(*finishBy))
+			}
 		}
 		return 0, nil
 	}
 
-	// Attempt to configure the terminal so that single characters can be read from stdin
-	oldTerminalState, err := terminal.ConfigureTerminal()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Warning: could not configure terminal. You have to use the enter key after each keyboard input.")
-		fmt.Fprintln(os.Stderr, err)
-	}
-	defer func() {
-		terminal.RestoreTerminal(oldTerminalState)
-	}()
-	// Send characters from stdin to a channel
-	mfaReader, mfaWriter = io.Pipe()
 	stdinInput := make(chan rune, 1)
-	go func() {
-		stdinReader := bufio.NewReader(os.Stdin)
-		var mfaCode string
-		for {
-			char, _, err := stdinReader.ReadRune()
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-			}
-			if promptingForMfa {
-				// This code is only used if the user is prompted for MFA after the upload has started (i.e. after the terminal has been configured)
-				// This looks a bit awkward but it is necessary since it is harder to reset the terminal and put back the rune that we already read
-				if char >= '0' && char <= '9' {
-					mfaCode += string(char)
-					fmt.Fprint(os.Stderr, string(char))
-				} else if (char == 127 || char == '\b') && len(mfaCode) > 0 {
-					mfaCode = mfaCode[:len(mfaCode)-1]
-					fmt.Fprint(os.Stderr, "\b\033[J")
-				} else if char == '\n' || char == '\r' {
-					fmt.Fprintln(os.Stderr)
-					mfaWriter.Write([]byte(mfaCode + "\n"))
-					mfaCode = ""
+	// Wakes up the waits when Ctrl-C is pressed (a key would be mistaken for a key press, since any key can be rebound)
+	wakeUp := make(chan struct{}, 1)
+	// The l key prompts for a transfer limit, which is read in the same way as the MFA code
+	// The prompt is handled by the goroutine that reads stdin, so that the characters typed after the key are never handled as key presses
+	var promptingForRate atomic.Bool
+	rateInput := make(chan string, 1)
+	// In non-interactive mode, stdin is only read if an MFA code is needed
+	var oldTerminalState *terminal.State
+	if interactive {
+		// Attempt to configure the terminal so that single characters can be read from stdin
+		oldTerminalState, err = terminal.ConfigureTerminal()
+		if err != nil {
+			fmt.Fprintln(warningOutput(), "Warning: could not configure terminal. You have to use the enter key after each keyboard input.")
+			fmt.Fprintln(warningOutput(), err)
+		}
+		defer func() {
+			terminal.RestoreTerminal(oldTerminalState)
+		}()
+		// Send characters from stdin to a channel
+		mfa.reader, mfaWriter = io.Pipe()
+		go func() {
+			stdinReader := bufio.NewReader(os.Stdin)
+			var mfaCode, rateExpr string
+			for {
+				char, _, err := stdinReader.ReadRune()
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return
 				}
-				continue
+				if mfa.prompting {
+					// This code is only used if the user is prompted for MFA after the upload has started (i.e. after the terminal has been configured)
+					// This looks a bit awkward but it is necessary since it is harder to reset the terminal and put back the rune that we already read
+					if char >= '0' && char <= '9' {
+						mfaCode += string(char)
+						fmt.Fprint(os.Stderr, string(char))
+					} else if (char == 127 || char == '\b') && len(mfaCode) > 0 {
+						mfaCode = mfaCode[:len(mfaCode)-1]
+						fmt.Fprint(os.Stderr, "\b\033[J")
+					} else if char == '\n' || char == '\r' {
+						fmt.Fprintln(os.Stderr)
+						mfaWriter.Write([]byte(mfaCode + "\n"))
+						mfaCode = ""
+					}
+					continue
+				}
+				// Escape sequences (e.g. arrow keys) are ignored
+				if char == 27 && skipEscapeSequence(stdinReader) {
+					continue
+				}
+				if promptingForRate.Load() {
+					if char == 127 || char == '\b' {
+						if len(rateExpr) > 0 {
+							rateExpr = rateExpr[:len(rateExpr)-1]
+							fmt.Fprint(os.Stderr, "\b\033[J")
+						}
+					} else if char == '\n' || char == '\r' {
+						promptingForRate.Store(false)
+						rateInput <- rateExpr
+						rateExpr = ""
+					} else if char == 27 {
+						// Escape cancels
+						promptingForRate.Store(false)
+						rateInput <- ""
+						rateExpr = ""
+					} else if char > ' ' && char < 127 {
+						rateExpr += string(char)
+						fmt.Fprint(os.Stderr, string(char))
+					}
+					continue
+				}
+				if char == keys.prompt {
+					promptingForRate.Store(true)
+					fmt.Fprint(os.Stderr, "\n\nNew transfer limit (e.g. \"35m\", \"unlimited\", \"+5m\" or \"50%\", escape to cancel): ")
+					continue
+				}
+				stdinInput <- char
 			}
-			stdinInput <- char
-		}
-	}()
+		}()
+	}
 
 	// Control variables
 	var reader *flowrate.Reader
+	var ui *tui
+	var lastProgress time.Time
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The same token bucket is used for all parts so that the limit carries over from one part to the next
+	// With --host-bwlimit and --background, the bucket is a child of buckets that are adjusted automatically (a token is needed from every bucket in the hierarchy)
+	var parentLimiter *flowrate.Bucket
+	newBucket := func(rate int64) *flowrate.Bucket {
+		if parentLimiter == nil {
+			return flowrate.NewBucket(rate, burst)
+		}
+		return parentLimiter.NewChild(rate, burst)
+	}
+	var coordinator *hostCoordinator
+	if hostRate != 0 {
+		parentLimiter = newBucket(hostRate)
+		var err error
+		coordinator, err = newHostCoordinator(hostRate, hostWeight, parentLimiter)
+		if err != nil {
+			return 1, fmt.Errorf("Error registering with the other shrimp processes: %w", err)
+		}
+		defer coordinator.close()
+		go coordinator.run(ctx)
+	}
+	var ifaceLimiter *interfaceLimiter
+	if interfaceRate != 0 {
+		parentLimiter = newBucket(0)
+		var err error
+		ifaceLimiter, err = newInterfaceLimiter(networkInterface, interfaceRate, parentLimiter)
+		if err != nil {
+			return 1, fmt.Errorf("Error: %w", err)
+		}
+		go ifaceLimiter.run(ctx)
+	}
+	var backgroundCtl *backgroundController
+	if background {
+		probeHost, probePort := fmt.Sprintf("s3.%s.amazonaws.com", client.Options().Region), "443"
+		if useAccelerateEndpoint {
+			probeHost = "s3-accelerate.amazonaws.com"
+		}
+		if endpointURL != "" {
+			u, err := url.Parse(endpointURL)
+			if err != nil {
+				return 1, err
+			}
+			probeHost, probePort = u.Hostname(), u.Port()
+			if probePort == "" && u.Scheme == "http" {
+				probePort = "80"
+			} else if probePort == "" {
+				probePort = "443"
+			}
+		}
+		parentLimiter = newBucket(0)
+		backgroundCtl = newBackgroundController(probeHost, probePort, parentLimiter, rate)
+	}
+	limiter := newBucket(rate)
+	// setActive is called when the upload starts and stops, since only active uploads get a share of the host-wide limit and background mode only adjusts the limit while uploading
+	setActive := func(active bool) {
+		if coordinator != nil {
+			coordinator.setActive(active)
+		}
+		if backgroundCtl != nil {
+			backgroundCtl.setActive(active)
+		}
+	}
+	// effectiveRate is the lowest of the transfer limit and the limits that are adjusted automatically
+	effectiveRate := func() int64 {
+		effectiveRate := rate
+		for b := limiter.Parent(); b != nil; b = b.Parent() {
+			effectiveRate = minLimit(effectiveRate, b.Rate())
+		}
+		return effectiveRate
+	}
+	if backgroundCtl != nil {
+		go backgroundCtl.run(ctx, func() int64 {
+			return rate
+		}, func() int64 {
+			if reader == nil {
+				return 0
+			}
+			return reader.Status().CurRate
+		})
+	}
+	// formatCurrentLimit is used in the status line
+	formatCurrentLimit := func(parenthesis bool) string {
+		if backgroundCtl != nil {
+			return formatAdaptiveLimit(effectiveRate(), parenthesis)
+		}
+		return formatLimit(effectiveRate(), parenthesis)
+	}
 	var oldRate int64
 	interrupted := false
 	paused := false
 	waitingToUnpause := false
 	waitingAfterError := false
+	var override *rateOverride
+	deadlineUnreachable := false
+	stopping := false
+	// limitSource describes where the current limit comes from
+	limitSource := func() string {
+		source := "manual"
+		if override != nil {
+			source = "override"
+		} else if finishBy != nil {
+			source = "deadline"
+		} else if schedule != nil {
+			source = "schedule"
+		}
+		if effectiveRate() != rate {
+			var automatic []string
+			if coordinator != nil {
+				automatic = append(automatic, "host limit")
+			}
+			if ifaceLimiter != nil {
+				automatic = append(automatic, "interface")
+			}
+			if backgroundCtl != nil {
+				automatic = append(automatic, "background mode")
+			}
+			source = fmt.Sprintf("%s, %s limit: %s", strings.Join(automatic, ", "), source, formatLimit2(rate))
+		}
+		return source
+	}
+
+	stopReached := func() bool {
+		return stopAt != nil && !time.Now().Before(*stopAt)
+	}
+	stopUpload := func() (int, error) {
+		fmt.Fprintf(infoOutput(), "The stop time has been reached. %s of %s has been uploaded.\n", formatFilesize(offset), formatFilesize(fileSize))
+		fmt.Fprintln(infoOutput(), "Run this command to resume the upload (add --stop-at or --run-for to limit it again):")
+		fmt.Fprintln(infoOutput(), shellQuoteArgs(resumeArgs(os.Args, configSources)))
+		return exitCodeStopped, nil
+	}
+
+	// scheduledRate returns the rate that the schedule wants right now (or the initial rate if there is no schedule)
+	scheduledRate := func() int64 {
+		if schedule != nil {
+			scheduledRate, _ := schedule.rateAt(time.Now())
+			return scheduledRate
+		}
+		return initialRate
+	}
+
+	// In deadline mode, the rate is continuously recalculated from the number of bytes remaining
+	// Since this simulates the schedule, it is only done when a part starts (force), at the next schedule transition, when the upload has fallen behind, and at least once a minute
+	var deadlineCheckedAt, deadlineRecheckAt time.Time
+	var deadlineBytesRemaining int64
+	updateDeadlineRate := func(bytesRemaining int64, force bool) {
+		if finishBy == nil || override != nil || paused {
+			return
+		}
+		now := time.Now()
+		if !force && now.Before(deadlineRecheckAt) {
+			expected := deadlineBytesRemaining - int64(float64(rate)*now.Sub(deadlineCheckedAt).Seconds())
+			if rate == 0 || float64(bytesRemaining-expected) <= 0.05*float64(deadlineBytesRemaining) {
+				return
+			}
+		}
+		deadlineCheckedAt = now
+		deadlineBytesRemaining = bytesRemaining
+		deadlineRecheckAt = now.Add(time.Minute)
+		if schedule != nil {
+			if _, until := schedule.rateAt(now); until.Before(deadlineRecheckAt) {
+				deadlineRecheckAt = until
+			}
+		}
+		newRate, ok := deadlineRate(bytesRemaining, *finishBy, schedule, now)
+		if ok {
+			if deadlineUnreachable {
+				fmt.Fprintf(infoOutput(), "\nThe deadline (%s) can be met again.\n", formatTime(*finishBy))
+				deadlineUnreachable = false
+			}
+		} else {
+			if !deadlineUnreachable {
+				fmt.Fprintf(warningOutput(), "\nWarning: The deadline (%s) can not be met under the current schedule. Uploading as fast as the schedule allows.\n", formatTime(*finishBy))
+				deadlineUnreachable = true
+			}
+			newRate = 0
+		}
+		if schedule != nil {
+			if scheduledRate, _ := schedule.rateAt(now); scheduledRate != 0 && (newRate == 0 || scheduledRate < newRate) {
+				newRate = scheduledRate
+			}
+		}
+		rate = newRate
+		if reader != nil {
+			reader.SetLimit(rate)
+		}
+	}
+
+	// Manual changes to the rate are tracked as an override so that they are not overwritten by the schedule
+	setOverride := func(newRate int64) {
+		if override == nil {
+			override = newRateOverride(newRate, overrideDuration, keys.schedule)
+		} else {
+			override.rate = newRate
+		}
+		rate = newRate
+		if reader != nil {
+			reader.SetLimit(rate)
+		}
+		fmt.Fprintf(os.Stderr, "\nTransfer limit set to: %s.", override)
+		if !override.expires.IsZero() {
+			fmt.Fprintf(os.Stderr, " Press %s to extend the override.", keyName(keys.extendOverride))
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	clearOverride := func() {
+		override = nil
+		if finishBy != nil {
+			// The rate is recalculated after the key has been handled
+			deadlineRecheckAt = time.Time{}
+			fmt.Fprintln(os.Stderr, "Returning to deadline mode.")
+			return
+		}
+		rate = scheduledRate()
+		if reader != nil {
+			reader.SetLimit(rate)
+		}
+		fmt.Fprintf(os.Stderr, "Returning to the scheduled transfer limit: %s.\n", formatLimit2(rate))
+	}
 
 	// Trap Ctrl-C signal
 	signalChannel := make(chan os.Signal, 1)
@@ -669,6 +1687,9 @@ func run() (int, error) {
 				continue
 			}
 			if interrupted || waitingAfterError {
+				if ui != nil {
+					ui.stop()
+				}
 				if oldTerminalState != nil {
 					terminal.RestoreTerminal(oldTerminalState)
 				}
@@ -677,86 +1698,499 @@ func run() (int, error) {
 			}
 			interrupted = true
 			if waitingToUnpause {
-				stdinInput <- 'q'
+				select {
+				case wakeUp <- struct{}{}:
+				default:
+				}
 				continue
 			}
-			fmt.Fprintln(os.Stderr, "\nInterrupt received, finishing current part. Press Ctrl-C again to exit immediately. Press the space key to cancel exit.")
+			fmt.Fprintf(os.Stderr, "\nInterrupt received, finishing current part. Press Ctrl-C again to exit immediately. Press %s to cancel exit.\n", keyPhrase(keys.pause))
 		}
 	}()
 
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr, "Tip: Press ? to see the available keyboard controls.")
+	if interactive {
+		fmt.Fprintln(infoOutput())
+		fmt.Fprintf(infoOutput(), "Tip: Press %s to see the available keyboard controls.\n", keyName(keys.help))
+	}
 
 	// Start the scheduler
 	if schedule != nil && len(schedule.blocks) > 0 {
-		block := schedule.next()
-		if block.active() {
-			rate = block.rate
-		}
+		rate = scheduledRate()
 
 		go func() {
 			for {
-				block := schedule.next()
-				start, end := block.next()
-
-				for time.Now().Before(start) {
-					time.Sleep(minDuration(time.Minute, time.Until(start)))
-				}
+				newRate, until := schedule.rateAt(time.Now())
 
-				if !paused && rate != block.rate {
-					fmt.Fprintf(os.Stderr, "\nScheduler: set ratelimit to %s.\n", formatLimit2(block.rate))
-					rate = block.rate
-					if reader != nil {
-						reader.SetLimit(rate)
-					}
-					fmt.Fprintln(os.Stderr)
-				}
-
-				for time.Now().Before(end) {
-					time.Sleep(minDuration(time.Minute, time.Until(end)))
-				}
-
-				// Check if the next block is right after the one we just did, otherwise reset to defaultRate
-				if !paused {
-					block = schedule.next()
-					if block.active() && rate != schedule.defaultRate {
-						fmt.Fprintf(os.Stderr, "\nScheduler: reset ratelimit to default (%s).\n", formatLimit2(schedule.defaultRate))
-						rate = schedule.defaultRate
+				if !paused && rate != newRate {
+					if override != nil {
+						fmt.Fprintf(infoOutput(), "\nScheduler: the schedule wants %s but the override remains active. Press %s to return to the schedule.\n", formatLimit2(newRate), keyName(keys.schedule))
+					} else if finishBy == nil {
+						fmt.Fprintf(infoOutput(), "\nScheduler: set ratelimit to %s.\n", formatLimit2(newRate))
+						rate = newRate
 						if reader != nil {
 							reader.SetLimit(rate)
 						}
+						fmt.Fprintln(infoOutput())
 					}
 				}
+
+				for time.Now().Before(until) {
+					time.Sleep(minDuration(time.Minute, time.Until(until)))
+				}
 			}
 		}()
 	}
 
-	for offset < fileSize {
+	completeUpload := func() (*s3.CompleteMultipartUploadOutput, error) {
+		fmt.Fprintln(infoOutput(), "Completing the multipart upload.")
+		completeMultipartUploadInput := &s3.CompleteMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadId),
+			MultipartUpload: &s3Types.CompletedMultipartUpload{
+				Parts: parts,
+			},
+			ExpectedBucketOwner:  aws.String(expectedBucketOwner),
+			RequestPayer:         s3Types.RequestPayer(requestPayer),
+			SSECustomerAlgorithm: aws.String(sseCustomerAlgorithm),
+			SSECustomerKey:       aws.String(sseCustomerKeyEncoded),
+			SSECustomerKeyMD5:    aws.String(sseCustomerKeyMD5),
+		}
+		completeMultipartUploadOutput, err := client.CompleteMultipartUpload(context.TODO(), completeMultipartUploadInput)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			err = removeUploadState(bucket, key, uploadId)
+			if err != nil {
+				fmt.Fprintf(warningOutput(), "Warning: Error removing the upload state: %v\n", err)
+			}
+		}
+		return completeMultipartUploadOutput, nil
+	}
+
+	// The parts of all the chunks are shown in the TUI
+	uiPartNumber := func() int32 {
+		return int32(chunkStart/partSize) + partNumber
+	}
+	if tuiFlag {
+		numParts := int(math.Ceil(float64(fileSize) / float64(partSize)))
+		ui, err = startTUI(numParts, int(uiPartNumber())-1, keys)
+		if err != nil {
+			return 1, err
+		}
+		defer ui.stop()
+	}
+
+	// The key presses and rate expressions are handled both while a part is uploading and while waiting for the file to grow (--follow)
+	var s flowrate.Status
+	handleRateInput := func(expr string) {
+		if expr == "" {
+			fmt.Fprintln(os.Stderr, "\nCancelled.")
+		} else if newRate, err := parseRateExpression(expr, rate); err != nil {
+			fmt.Fprintf(os.Stderr, "\nInvalid transfer limit: %v\n", err)
+		} else {
+			setOverride(newRate)
+		}
+	}
+	handleKey := func(r rune) {
+		if r == keys.info {
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintf(os.Stderr, "Uploading %s to %s\n", flag.Arg(0), flag.Arg(1))
+			if encryption != nil {
+				fmt.Fprintf(os.Stderr, "File size: %s (encrypted: %s)\n", formatFilesize(encryption.Size), formatFilesize(fileSize))
+				fmt.Fprintf(os.Stderr, "Client-side encryption: %s\n", encryption)
+			} else {
+				fmt.Fprintf(os.Stderr, "File size: %s\n", formatFilesize(fileSize))
+			}
+			fmt.Fprintf(os.Stderr, "Part size: %s\n", formatFilesize(partSize))
+			if storageClass != "" {
+				fmt.Fprintf(os.Stderr, "Storage class: %s\n", storageClass)
+			}
+			for _, option := range describeObjectOptions(&createMultipartUploadInput) {
+				fmt.Fprintln(os.Stderr, option)
+			}
+			if scheduleFn != "" {
+				fmt.Fprintf(os.Stderr, "Schedule: %s\n", scheduleFn)
+			}
+			for _, q := range quotas {
+				used, err := quotaUsed(quotaStateFn, q, time.Now())
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error reading quota state: %v\n", err)
+					break
+				}
+				fmt.Fprintf(os.Stderr, "Quota: %s of %s remaining this %s (resets at %s).\n", formatSize(max(q.limit-used, 0)), formatSize(q.limit), q.period, formatTime(q.periodEnd(time.Now())))
+			}
+			fmt.Fprintf(os.Stderr, "Currently uploading part %d out of %d.\n", partNumber, int64(math.Ceil(float64(fileSize)/float64(partSize))))
+			if finishBy != nil {
+				if override == nil {
+					fmt.Fprintf(os.Stderr, "Deadline: %s (limit: %s)\n", formatTime(*finishBy), formatLimit2(rate))
+				} else {
+					fmt.Fprintf(os.Stderr, "Deadline: %s (suspended by the override)\n", formatTime(*finishBy))
+				}
+			}
+			if override != nil {
+				fmt.Fprintf(os.Stderr, "Override: %s\n", override)
+			}
+			fmt.Fprintf(os.Stderr, "Scheduled transfer limit: %s\n", formatLimit2(scheduledRate()))
+			if coordinator != nil {
+				fmt.Fprintf(os.Stderr, "Host limit: %s\n", coordinator)
+			}
+			if backgroundCtl != nil {
+				fmt.Fprintf(os.Stderr, "Background mode: %s\n", backgroundCtl)
+			}
+			if ifaceLimiter != nil {
+				fmt.Fprintf(os.Stderr, "Network interface: %s\n", ifaceLimiter)
+			}
+			if schedule != nil {
+				_, until := schedule.rateAt(time.Now())
+				nextRate, _ := schedule.rateAt(until)
+				fmt.Fprintf(os.Stderr, "Next schedule transition: %s (%s)\n", formatTime(until), formatLimit2(nextRate))
+			}
+			if completion, ok := estimateStatusCompletion(s, rate, schedule); ok {
+				fmt.Fprintf(os.Stderr, "Estimated completion: %s (in %s).\n", formatTime(completion), time.Until(completion).Round(time.Second))
+			}
+			fmt.Fprintln(os.Stderr)
+		} else if r == keys.unlimited {
+			setOverride(0)
+		} else if r == keys.schedule {
+			fmt.Fprintln(os.Stderr)
+			clearOverride()
+		} else if r == keys.extendOverride {
+			if override == nil {
+				fmt.Fprintln(os.Stderr, "\nThere is no override to extend.")
+			} else {
+				override.extend(time.Hour)
+				fmt.Fprintf(os.Stderr, "\nOverride: %s.\n", override)
+			}
+		} else if step, ok := keys.step(r); ok {
+			newRate := rate
+			// Start from zero when increasing from the lowest rate (or from unlimited), unless the step is the lowest rate
+			if newRate <= 1e3 && (step < 0 || step > 1e3) {
+				newRate = 0
+			}
+			newRate += step
+			if newRate < 1e3 {
+				newRate = 1e3
+			}
+			setOverride(newRate)
+		} else if r >= '0' && r <= '9' {
+			n := int64(r - '0')
+			if n == 0 {
+				n = 10
+			}
+			setOverride(n * keys.digitStep)
+		} else if r == keys.pauseAfterPart {
+			// Pause after current part
+			paused = !paused
+			if paused {
+				fmt.Fprintln(os.Stderr, "\nTransfer will pause after the current part.")
+			} else {
+				fmt.Fprintln(os.Stderr, "\nWill not pause.")
+			}
+		} else if r == keys.pause {
+			// Pausing with the space key just lowers the rate to be very low
+			// Unpausing restores the old rate
+			if interrupted {
+				interrupted = false
+				fmt.Fprintln(os.Stderr, "\nExit cancelled.")
+			} else {
+				paused = !paused
+				if paused {
+					oldRate = rate
+					rate = 1e3
+				} else {
+					rate = oldRate
+				}
+				if reader != nil {
+					reader.SetLimit(rate)
+				}
+				if rate == 0 {
+					fmt.Fprint(os.Stderr, "\nUnlimited transfer rate.")
+				} else {
+					fmt.Fprintf(os.Stderr, "\nTransfer limit set to: %s/s.", formatSize(rate))
+				}
+				if paused {
+					fmt.Fprint(os.Stderr, " Transfer will pause after the current part.")
+				}
+				fmt.Fprintln(os.Stderr)
+			}
+		} else if r == keys.help {
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr)
+			for _, line := range keys.helpLines() {
+				fmt.Fprintln(os.Stderr, line)
+			}
+			fmt.Fprintln(os.Stderr)
+		} else if r == terminal.EnterKey {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+
+	for offset < fileSize || (follower != nil && !follower.complete) {
 		runtime.GC()
 
 		for paused {
+			setActive(false)
 			waitingToUnpause = true
 			if interrupted {
 				return 1, nil
 			}
-			fmt.Fprintln(os.Stderr, "Transfer is paused. Press the space key to resume.")
-			r := <-stdinInput
-			if r == ' ' {
-				fmt.Fprintln(os.Stderr, "Resuming.")
-				paused = false
+			fmt.Fprintf(os.Stderr, "Transfer is paused. Press %s to resume.\n", keyPhrase(keys.pause))
+			select {
+			case r := <-stdinInput:
+				if r == keys.pause {
+					fmt.Fprintln(os.Stderr, "Resuming.")
+					paused = false
+					waitingToUnpause = false
+				}
+			case <-wakeUp:
+			}
+		}
+
+		if stopReached() {
+			setActive(false)
+			return stopUpload()
+		}
+
+		// Complete the chunk and continue with the next one
+		if split != nil && offset == chunkEnd {
+			_, err := completeUpload()
+			if err != nil {
+				return 1, err
+			}
+			chunkIndex++
+			key = split.chunkKey(chunkIndex)
+			chunkStart, chunkEnd = split.chunkRange(chunkIndex)
+			fmt.Fprintf(infoOutput(), "\nUploading chunk %d of %d (s3://%s/%s).\n", chunkIndex+1, split.count, bucket, key)
+			err = prepareChunk()
+			if err != nil {
+				return 1, fmt.Errorf("Error: %w", err)
+			}
+			fmt.Fprintln(infoOutput(), "Creating multipart upload.")
+			outputCreateMultipartUpload, err := client.CreateMultipartUpload(context.TODO(), &createMultipartUploadInput)
+			if err != nil {
+				return 1, err
+			}
+			uploadId = aws.ToString(outputCreateMultipartUpload.UploadId)
+			fmt.Fprintf(infoOutput(), "Upload id: %v\n", uploadId)
+			parts = []s3Types.CompletedPart{}
+			partNumber = 1
+			if state != nil {
+				state.Key = key
+				state.UploadId = uploadId
+				err = writeUploadState(state)
+				if err != nil {
+					return 1, fmt.Errorf("Error saving the upload state (the upload can not be resumed without it): %w", err)
+				}
+			}
+		}
+
+		// Wait until the file has grown past the end of the part, or until it is complete
+		if follower != nil && !follower.complete && offset+partSize > fileSize {
+			waiting := false
+			for {
+				err := follower.poll()
+				if err != nil {
+					return 1, fmt.Errorf("Error following %s: %w.", file, err)
+				}
+				if follower.complete || offset+partSize <= follower.size || paused {
+					break
+				}
+				setActive(false)
+				waitingToUnpause = true
+				if interrupted {
+					return 1, nil
+				}
+				if stopReached() {
+					return stopUpload()
+				}
+				if !waiting {
+					fmt.Fprintf(infoOutput(), "Waiting for the file to grow (%s so far).\n", formatFilesize(follower.size))
+					waiting = true
+				}
+				select {
+				case <-time.After(followPollInterval):
+				case expr := <-rateInput:
+					handleRateInput(expr)
+				case r := <-stdinInput:
+					handleKey(r)
+				case <-wakeUp:
+				}
 				waitingToUnpause = false
 			}
+			fileSize = follower.size
+			chunkEnd = fileSize
+			if follower.complete {
+				fmt.Fprintf(infoOutput(), "The file is complete (%s). File size: %s\n", follower.reason, formatFilesize(fileSize))
+				if offset == fileSize {
+					break
+				}
+			}
+			if paused {
+				// Pause before the next part is started
+				continue
+			}
+		}
+
+		size := min(partSize, chunkEnd-offset)
+
+		// The data for this part. With compression, size is how much of the file the part covers and transferSize is the compressed size
+		var body io.ReadSeeker
+		transferSize := size
+		transferOffset, transferTotal := offset, fileSize
+		if comp != nil {
+			data, dataSize, rawSize, err := comp.compressPart(offset, partSize)
+			if err != nil {
+				return 1, fmt.Errorf("Error compressing part %d: %w", partNumber, err)
+			}
+			size = rawSize
+			transferSize = dataSize
+			transferOffset = compressedOffset
+			transferTotal = estimateCompressedSize(offset+size, compressedOffset+transferSize, fileSize)
+			body = data
+
+			// Record where the part starts before it is uploaded
+			part := compressedPart{RawOffset: offset, RawSize: size, Size: transferSize}
+			state.Compression.Parts = append(state.Compression.Parts[:partNumber-1], part)
+		} else {
+			body = io.NewSectionReader(source, offset, size)
+		}
+		if archive != nil {
+			tarOffset := offset + size
+			if encryption != nil {
+				tarOffset = encryption.plaintextOffset(offset + size)
+			}
+			part, err := archive.part(tarOffset)
+			if err != nil {
+				return 1, fmt.Errorf("Error: %w", err)
+			}
+			state.Tar.Parts = append(state.Tar.Parts[:partNumber-1], part)
+		}
+		if comp != nil || archive != nil {
+			err = writeUploadState(state)
+			if err != nil {
+				return 1, fmt.Errorf("Error saving the upload state: %w", err)
+			}
+		}
+		formatUncompressedRate := func(rate int64) string {
+			if comp == nil || transferSize == 0 {
+				return ""
+			}
+			return fmt.Sprintf(", %s/s uncompressed", formatSize(rate*size/transferSize))
 		}
 
+		// Wait if the next part would exceed a quota
+		var exceededQuota *Quota
+		for {
+			q, err := checkQuotas(quotaStateFn, quotas, transferSize, time.Now())
+			if err != nil {
+				return 1, err
+			}
+			if q == nil {
+				if exceededQuota != nil {
+					fmt.Fprintln(infoOutput(), "The quota has been reset. Resuming.")
+				}
+				break
+			}
+			if paused {
+				break
+			}
+			setActive(false)
+			waitingToUnpause = true
+			if interrupted {
+				return 1, nil
+			}
+			if stopReached() {
+				return stopUpload()
+			}
+			reset := q.periodEnd(time.Now())
+			if exceededQuota == nil || *exceededQuota != *q {
+				fmt.Fprintf(infoOutput(), "The quota of %s has been used up. Waiting until %s for the quota to reset.\n", q, formatTime(reset))
+				exceededQuota = q
+			}
+			wait := minDuration(time.Minute, time.Until(reset))
+			if stopAt != nil {
+				wait = minDuration(wait, time.Until(*stopAt))
+			}
+			select {
+			case <-time.After(wait):
+			case expr := <-rateInput:
+				handleRateInput(expr)
+			case r := <-stdinInput:
+				handleKey(r)
+			case <-wakeUp:
+			}
+			waitingToUnpause = false
+		}
+		if paused {
+			// Pause before the part is started
+			continue
+		}
+
+		// Wait while the system is busy
+		if maxLoad != 0 || maxIOPressure != 0 {
+			busy := false
+			for {
+				reason, err := checkHostLoad(maxLoad, maxIOPressure)
+				if err != nil {
+					return 1, fmt.Errorf("Error reading the system load: %w", err)
+				}
+				if reason == "" {
+					if busy {
+						fmt.Fprintln(infoOutput(), "The system load is back to normal. Resuming.")
+					}
+					break
+				}
+				if paused {
+					break
+				}
+				setActive(false)
+				waitingToUnpause = true
+				if interrupted {
+					return 1, nil
+				}
+				if stopReached() {
+					return stopUpload()
+				}
+				if !busy {
+					fmt.Fprintf(infoOutput(), "%s. Waiting before starting the next part.\n", reason)
+					busy = true
+				}
+				select {
+				case <-time.After(10 * time.Second):
+				case expr := <-rateInput:
+					handleRateInput(expr)
+				case r := <-stdinInput:
+					handleKey(r)
+				case <-wakeUp:
+				}
+				waitingToUnpause = false
+			}
+			if paused {
+				// Pause before the part is started
+				continue
+			}
+		}
+
+		updateDeadlineRate(transferTotal-transferOffset, true)
+		setActive(true)
+
 		partStartTime := time.Now()
-		size := min(partSize, fileSize-offset)
+		// The rate may have been changed with the keys before the first part was started
 		reader = flowrate.NewReader(
-			io.NewSectionReader(f, offset, size),
+			body,
 			rate,
 			!encryptedEndpoint,
 		)
-		reader.SetTransferSize(size)
-		reader.SetTotal(offset, fileSize)
+		reader.SetBucket(ctx, limiter)
+		reader.SetTransferSize(transferSize)
+		reader.SetTotal(transferOffset, transferTotal)
+
+		if ui != nil {
+			ui.setPart(uiPartNumber(), partInFlight)
+		}
 
 		// Start the upload in a go routine
 		doneCh := make(chan struct{})
@@ -774,148 +2208,112 @@ func run() (int, error) {
 				ExpectedBucketOwner:  aws.String(expectedBucketOwner),
 				RequestPayer:         s3Types.RequestPayer(requestPayer),
 				SSECustomerAlgorithm: aws.String(sseCustomerAlgorithm),
-				SSECustomerKey:       aws.String(sseCustomerKey),
+				SSECustomerKey:       aws.String(sseCustomerKeyEncoded),
+				SSECustomerKeyMD5:    aws.String(sseCustomerKeyMD5),
 			}
-			uploadPart, uploadErr = client.UploadPart(context.TODO(), uploadPartInput)
+			uploadPart, uploadErr = client.UploadPart(ctx, uploadPartInput)
 			if debug && uploadPart != nil {
 				fmt.Fprintf(os.Stderr, "Part: %s\n", string(jsonMustMarshal(uploadPart)))
 			}
 		}()
 
 		// Main loop while the upload is in progress
-		var s flowrate.Status
+		s = flowrate.Status{}
 		for doneCh != nil {
 			select {
 			case <-doneCh:
 				doneCh = nil
 			case <-time.After(time.Second):
+			case expr := <-rateInput:
+				handleRateInput(expr)
 			case r := <-stdinInput:
-				if r == 'i' {
-					fmt.Fprintln(os.Stderr)
-					fmt.Fprintln(os.Stderr)
-					fmt.Fprintf(os.Stderr, "Uploading %s to %s\n", flag.Arg(0), flag.Arg(1))
-					fmt.Fprintf(os.Stderr, "File size: %s\n", formatFilesize(fileSize))
-					fmt.Fprintf(os.Stderr, "Part size: %s\n", formatFilesize(partSize))
-					if storageClass != "" {
-						fmt.Fprintf(os.Stderr, "Storage class: %s\n", storageClass)
-					}
-					if scheduleFn != "" {
-						fmt.Fprintf(os.Stderr, "Schedule: %s\n", scheduleFn)
-					}
-					fmt.Fprintf(os.Stderr, "Currently uploading part %d out of %d.\n", partNumber, int64(math.Ceil(float64(fileSize)/float64(partSize))))
-					fmt.Fprintln(os.Stderr)
-				} else if r == 'u' {
-					rate = 0
-					reader.SetLimit(rate)
-					fmt.Fprint(os.Stderr, "\nUnlimited transfer rate.\n")
-				} else if r == 'r' {
-					rate = initialRate
-					reader.SetLimit(rate)
-					if rate == 0 {
-						fmt.Fprint(os.Stderr, "\nUnlimited transfer rate.")
-					} else {
-						fmt.Fprintf(os.Stderr, "\nTransfer limit set to: %s/s.", formatSize(rate))
-					}
-				} else if r == 'a' || r == 's' || r == 'd' || r == 'f' ||
-					r == 'z' || r == 'x' || r == 'c' || r == 'v' {
-					if rate <= 1e3 && r != 'a' {
-						rate = 0
-					}
-					if r == 'a' {
-						rate += 1e3
-					} else if r == 's' {
-						rate += 10e3
-					} else if r == 'd' {
-						rate += 100e3
-					} else if r == 'f' {
-						rate += 250e3
-					} else if r == 'z' {
-						rate -= 1e3
-					} else if r == 'x' {
-						rate -= 10e3
-					} else if r == 'c' {
-						rate -= 100e3
-					} else if r == 'v' {
-						rate -= 250e3
-					}
-					if rate < 1e3 {
-						rate = 1e3
-					}
-					reader.SetLimit(rate)
-					fmt.Fprintf(os.Stderr, "\nTransfer limit set to: %s/s\n", formatSize(rate))
-				} else if r >= '0' && r <= '9' {
-					n := int64(r - '0')
-					if n == 0 {
-						rate = 1e6
-					} else {
-						rate = n * 100e3
-					}
-					reader.SetLimit(rate)
-					fmt.Fprintf(os.Stderr, "\nTransfer limit set to: %s/s\n", formatSize(rate))
-				} else if r == 'p' {
-					// Pause after current part
-					paused = !paused
-					if paused {
-						fmt.Fprintln(os.Stderr, "\nTransfer will pause after the current part.")
-					} else {
-						fmt.Fprintln(os.Stderr, "\nWill not pause.")
-					}
-				} else if r == ' ' {
-					// Pausing with the space key just lowers the rate to be very low
-					// Unpausing restores the old rate
-					if interrupted {
-						interrupted = false
-						fmt.Fprintln(os.Stderr, "\nExit cancelled.")
-					} else {
-						paused = !paused
-						if paused {
-							oldRate = rate
-							rate = 1e3
-						} else {
-							rate = oldRate
-						}
-						reader.SetLimit(rate)
-						if rate == 0 {
-							fmt.Fprint(os.Stderr, "\nUnlimited transfer rate.")
-						} else {
-							fmt.Fprintf(os.Stderr, "\nTransfer limit set to: %s/s.", formatSize(rate))
-						}
-						if paused {
-							fmt.Fprint(os.Stderr, " Transfer will pause after the current part.")
-						}
-						fmt.Fprintln(os.Stderr)
-					}
-				} else if r == '?' {
-					fmt.Fprintln(os.Stderr)
-					fmt.Fprintln(os.Stderr)
-					fmt.Fprintln(os.Stderr, "i       - print information about the upload")
-					fmt.Fprintln(os.Stderr, "u       - set to unlimited transfer rate")
-					fmt.Fprintln(os.Stderr, "r       - restore initial transfer limit (from --bwlimit)")
-					fmt.Fprintln(os.Stderr, "a s d f - increase transfer limit by 1, 10, 100, or 250 kB/s")
-					fmt.Fprintln(os.Stderr, "z x c v - decrease transfer limit by 1, 10, 100, or 250 kB/s")
-					fmt.Fprintln(os.Stderr, "0-9     - limit the transfer rate to 0.X MB/s")
-					fmt.Fprintln(os.Stderr, "p       - pause transfer after current part")
-					fmt.Fprintln(os.Stderr, "[space] - pause transfer (sets transfer limit to 1 kB/s)")
-					fmt.Fprintln(os.Stderr, "Ctrl-C  - exit after current part")
-					fmt.Fprintln(os.Stderr, "          press twice to abort immediately")
-					fmt.Fprintln(os.Stderr)
-				} else if r == terminal.EnterKey {
-					fmt.Fprintln(os.Stderr)
-				}
-			}
-
-			for promptingForMfa {
+				handleKey(r)
+			}
+
+			for mfa.prompting {
 				time.Sleep(time.Second)
 			}
 
+			if !stopping && stopReached() {
+				stopping = true
+				fmt.Fprintln(infoOutput(), "\nThe stop time has been reached, finishing current part.")
+			}
+
+			if override != nil && override.expired() && !paused {
+				fmt.Fprintln(os.Stderr, "\nThe override has expired.")
+				clearOverride()
+			}
+
 			s = reader.Status()
-			fmt.Fprintf(os.Stderr, "\033[2K\rUploading part %d: %s, %s/s%s, %s remaining. (total: %s, %s remaining)", partNumber, s.Progress, formatSize(s.CurRate), formatLimit(rate, true), s.TimeRem.Round(time.Second), s.TotalProgress, s.TotalTimeRem.Round(time.Second))
+			updateDeadlineRate(s.TotalBytesRem, false)
+			if promptingForRate.Load() && ui == nil {
+				// Do not overwrite the prompt
+				continue
+			}
+			if ui != nil {
+				info := tuiInfo{
+					title:       fmt.Sprintf("Uploading %s to %s", flag.Arg(0), flag.Arg(1)),
+					partNumber:  partNumber,
+					status:      s,
+					rate:        formatSize(s.CurRate) + "/s" + formatUncompressedRate(s.CurRate),
+					limit:       effectiveRate(),
+					limitSource: limitSource(),
+					remaining:   formatTimeRemaining(s, rate, schedule),
+				}
+				if schedule != nil {
+					_, until := schedule.rateAt(time.Now())
+					nextRate, _ := schedule.rateAt(until)
+					info.nextTransition = fmt.Sprintf("%s (%s)", formatTime(until), formatLimit2(nextRate))
+				}
+				if interrupted {
+					info.notice = "Exiting after the current part."
+				} else if stopping {
+					info.notice = "Stopping after the current part."
+				} else if paused {
+					info.notice = "Transfer will pause after the current part."
+				}
+				ui.update(info)
+				continue
+			}
+			if noProgress || time.Since(lastProgress) < progressInterval {
+				continue
+			}
+			lastProgress = time.Now()
+			if interactive {
+				fmt.Fprint(infoOutput(), "\033[2K\r")
+			}
+			fmt.Fprintf(infoOutput(), "Uploading part %d: %s, %s/s%s%s, %s remaining. (total: %s, %s)", partNumber, s.Progress, formatSize(s.CurRate), formatCurrentLimit(true), formatUncompressedRate(s.CurRate), s.TimeRem.Round(time.Second), s.TotalProgress, formatTimeRemaining(s, rate, schedule))
+			if !interactive {
+				// Plain log lines
+				fmt.Fprintln(infoOutput())
+			}
 		}
 
 		// Part upload has completed or failed
+		if len(quotas) > 0 {
+			// Failed parts also count toward the quota since the data was sent
+			n := transferSize
+			if uploadErr != nil {
+				n = s.Bytes
+			}
+			err := addQuotaUsage(quotaStateFn, quotas, n, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "\nError recording quota usage: %v\n", err)
+			}
+		}
+		if ui != nil {
+			if uploadErr == nil {
+				ui.setPart(uiPartNumber(), partDone)
+			} else {
+				ui.setPart(uiPartNumber(), partFailed)
+			}
+		}
 		if uploadErr == nil {
 			timeElapsed := niceDuration(time.Since(partStartTime))
-			fmt.Fprintf(os.Stderr, "\033[2K\rUploaded part %d in %s (%s/s%s). (total: %s, %s remaining)\n", partNumber, timeElapsed, formatSize(s.CurRate), formatLimit(rate, false), s.TotalProgress, s.TotalTimeRem.Round(time.Second))
+			if interactive {
+				fmt.Fprint(infoOutput(), "\033[2K\r")
+			}
+			fmt.Fprintf(infoOutput(), "Uploaded part %d in %s (%s/s%s%s). (total: %s, %s)\n", partNumber, timeElapsed, formatSize(s.CurRate), formatCurrentLimit(false), formatUncompressedRate(s.CurRate), s.TotalProgress, formatTimeRemaining(s, rate, schedule))
 
 			// Check if the user wants to stop
 			if interrupted {
@@ -931,6 +2329,7 @@ func run() (int, error) {
 				ChecksumSHA256: uploadPart.ChecksumSHA256,
 			})
 			offset += size
+			compressedOffset += transferSize
 			partNumber += 1
 		} else {
 			fmt.Fprintln(os.Stderr)
@@ -947,6 +2346,9 @@ func run() (int, error) {
 		}
 	}
 	signal.Reset(os.Interrupt)
+	if ui != nil {
+		ui.stop()
+	}
 
 	// Do a sanity check
 	if offset != fileSize {
@@ -954,25 +2356,46 @@ func run() (int, error) {
 	}
 
 	// Complete the upload
-	fmt.Fprintln(os.Stderr, "Completing the multipart upload.")
-	completeMultipartUploadInput := &s3.CompleteMultipartUploadInput{
-		Bucket:   aws.String(bucket),
-		Key:      aws.String(key),
-		UploadId: aws.String(uploadId),
-		MultipartUpload: &s3Types.CompletedMultipartUpload{
-			Parts: parts,
-		},
-		ExpectedBucketOwner:  aws.String(expectedBucketOwner),
-		RequestPayer:         s3Types.RequestPayer(requestPayer),
-		SSECustomerAlgorithm: aws.String(sseCustomerAlgorithm),
-		SSECustomerKey:       aws.String(sseCustomerKey),
-	}
-	completeMultipartUploadOutput, err := client.CompleteMultipartUpload(context.TODO(), completeMultipartUploadInput)
+	completeMultipartUploadOutput, err := completeUpload()
 	if err != nil {
 		return 1, err
 	}
-	fmt.Fprintln(os.Stderr, "All done!")
-	fmt.Fprintln(os.Stderr)
+	if split != nil {
+		err = writeSplitManifest()
+		if err != nil {
+			return 1, fmt.Errorf("Error uploading the manifest: %w", err)
+		}
+	}
+
+	// Store the list of archived files next to the archive (encrypted with the same key or passphrase, since the names of the files may be sensitive)
+	if archive != nil {
+		manifestKey := key + manifestSuffix
+		fmt.Fprintf(infoOutput(), "Uploading the manifest to s3://%s/%s\n", bucket, manifestKey)
+		manifest, err := archive.manifest(bucket, key, compressFormat, encryption != nil)
+		if err != nil {
+			return 1, fmt.Errorf("Error creating the manifest: %w", err)
+		}
+		putObjectInput := newManifestInput(manifestKey, manifest)
+		if encryption != nil {
+			params, manifestDataKey, err := newEncryptionParams(cseSecret, int64(len(manifest)))
+			if err != nil {
+				return 1, fmt.Errorf("Error encrypting the manifest: %w", err)
+			}
+			r, err := newEncryptingReaderAt(bytes.NewReader(manifest), params, manifestDataKey)
+			if err != nil {
+				return 1, fmt.Errorf("Error encrypting the manifest: %w", err)
+			}
+			putObjectInput.Body = io.NewSectionReader(r, 0, params.encryptedSize())
+			putObjectInput.ContentType = aws.String("application/octet-stream")
+			putObjectInput.Metadata = map[string]string{encryptionMetadataKey: params.metadataValue()}
+		}
+		_, err = client.PutObject(context.TODO(), putObjectInput)
+		if err != nil {
+			return 1, fmt.Errorf("Error uploading the manifest: %w", err)
+		}
+	}
+	fmt.Fprintln(infoOutput(), "All done!")
+	fmt.Fprintln(infoOutput())
 
 	// Print the response data from CompleteMultipartUpload as the program's standard output
 	output, err := jsonMarshalSortedIndent(completeMultipartUploadOutput, "", "  ")
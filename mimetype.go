@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Content types for common extensions, used when the system's MIME type database does not know the extension (it may be missing entirely, e.g. in containers)
+var bundledMimeTypes = map[string]string{
+	".7z":      "application/x-7z-compressed",
+	".aac":     "audio/aac",
+	".apk":     "application/vnd.android.package-archive",
+	".avi":     "video/x-msvideo",
+	".bmp":     "image/bmp",
+	".bz2":     "application/x-bzip2",
+	".csv":     "text/csv",
+	".deb":     "application/vnd.debian.binary-package",
+	".dmg":     "application/x-apple-diskimage",
+	".doc":     "application/msword",
+	".docx":    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".epub":    "application/epub+zip",
+	".flac":    "audio/flac",
+	".gz":      "application/gzip",
+	".heic":    "image/heic",
+	".ico":     "image/vnd.microsoft.icon",
+	".ics":     "text/calendar",
+	".iso":     "application/x-iso9660-image",
+	".jar":     "application/java-archive",
+	".log":     "text/plain",
+	".m4a":     "audio/mp4",
+	".md":      "text/markdown",
+	".mkv":     "video/x-matroska",
+	".mov":     "video/quicktime",
+	".mp3":     "audio/mpeg",
+	".mp4":     "video/mp4",
+	".odt":     "application/vnd.oasis.opendocument.text",
+	".ogg":     "audio/ogg",
+	".otf":     "font/otf",
+	".parquet": "application/vnd.apache.parquet",
+	".ppt":     "application/vnd.ms-powerpoint",
+	".pptx":    "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".rpm":     "application/x-rpm",
+	".rtf":     "application/rtf",
+	".sh":      "application/x-sh",
+	".sql":     "application/sql",
+	".tar":     "application/x-tar",
+	".tgz":     "application/gzip",
+	".tif":     "image/tiff",
+	".tiff":    "image/tiff",
+	".toml":    "application/toml",
+	".ttf":     "font/ttf",
+	".txt":     "text/plain",
+	".wav":     "audio/wav",
+	".webm":    "video/webm",
+	".woff":    "font/woff",
+	".woff2":   "font/woff2",
+	".xls":     "application/vnd.ms-excel",
+	".xlsx":    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".xz":      "application/x-xz",
+	".yaml":    "application/yaml",
+	".yml":     "application/yaml",
+	".zip":     "application/zip",
+	".zst":     "application/zstd",
+}
+
+// guessContentType guesses the content type from the file extension, like the aws cli. If the extension is not recognized and sniff is true, the content type is detected from the beginning of the file. It returns an empty string if the content type could not be determined, along with a description of how it was determined.
+func guessContentType(fn string, sniff bool) (string, string, error) {
+	ext := strings.ToLower(filepath.Ext(fn))
+	if ext != "" {
+		if t := mime.TypeByExtension(ext); t != "" {
+			return t, "guessed from the extension", nil
+		}
+		if t, ok := bundledMimeTypes[ext]; ok {
+			return t, "guessed from the extension", nil
+		}
+	}
+	if !sniff {
+		return "", "", nil
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	// DetectContentType considers at most 512 bytes
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", "", err
+	}
+	t := http.DetectContentType(buf[:n])
+	if t == "application/octet-stream" {
+		return "", "", nil
+	}
+	return t, "detected from the content", nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3 limits for user-defined metadata and tags
+const (
+	maxMetadataSize   = 2 * 1024 // The sum of the lengths of the keys and values, in bytes
+	maxTags           = 10
+	maxTagKeyLength   = 128 // In Unicode characters
+	maxTagValueLength = 256 // In Unicode characters
+)
+
+// Grants use the same format as the aws cli: Permission=Grantee_Type=Grantee_ID
+var grantPermissions = []string{"read", "readacl", "writeacl", "full"}
+var grantGranteeTypes = map[string]string{
+	"uri":          "uri",
+	"emailaddress": "emailAddress",
+	"id":           "id",
+}
+
+// applyGrants parses the grants and sets the grant headers. Each value can contain several grants separated by spaces.
+func applyGrants(input *s3.CreateMultipartUploadInput, grants []string) error {
+	headers := make(map[string][]string)
+	for _, value := range grants {
+		for _, grant := range strings.Fields(value) {
+			permission, grantee, found := strings.Cut(grant, "=")
+			if !found {
+				return fmt.Errorf("grants should be of the form permission=principal: %s", grant)
+			}
+			granteeType, granteeId, found := strings.Cut(grantee, "=")
+			if !found || granteeId == "" {
+				return fmt.Errorf("grants should be of the form permission=principal: %s", grant)
+			}
+			permission = strings.ToLower(permission)
+			if !contains(grantPermissions, permission) {
+				return fmt.Errorf("permission must be one of: %s (got %s)", strings.Join(grantPermissions, ", "), permission)
+			}
+			headerType, ok := grantGranteeTypes[strings.ToLower(granteeType)]
+			if !ok {
+				return fmt.Errorf("grantee type must be one of: uri, emailaddress, id (got %s)", granteeType)
+			}
+			headers[permission] = append(headers[permission], fmt.Sprintf("%s=\"%s\"", headerType, granteeId))
+		}
+	}
+	if v, ok := headers["read"]; ok {
+		input.GrantRead = aws.String(strings.Join(v, ", "))
+	}
+	if v, ok := headers["readacl"]; ok {
+		input.GrantReadACP = aws.String(strings.Join(v, ", "))
+	}
+	if v, ok := headers["writeacl"]; ok {
+		input.GrantWriteACP = aws.String(strings.Join(v, ", "))
+	}
+	if v, ok := headers["full"]; ok {
+		input.GrantFullControl = aws.String(strings.Join(v, ", "))
+	}
+	return nil
+}
+
+// parseEncryptionContext accepts a JSON object, either as is or base64-encoded, and returns it base64-encoded.
+func parseEncryptionContext(s string) (string, error) {
+	data := []byte(s)
+	if !strings.HasPrefix(strings.TrimSpace(s), "{") {
+		var err error
+		data, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", errors.New("the encryption context must be a JSON object (optionally base64-encoded)")
+		}
+	}
+	var context map[string]string
+	err := json.Unmarshal(data, &context)
+	if err != nil {
+		return "", fmt.Errorf("the encryption context must be a JSON object with string values: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// readParameterValue reads the value from a file if it starts with file:// or fileb://, like the aws cli. A trailing newline is removed from file:// values, fileb:// values are used as is.
+func readParameterValue(s string) (string, error) {
+	if fn, found := strings.CutPrefix(s, "file://"); found {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	} else if fn, found := strings.CutPrefix(s, "fileb://"); found {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return s, nil
+}
+
+// parseMetadata accepts a JSON object or the shorthand syntax key1=value1,key2=value2 (the values can not contain commas), optionally read from a file.
+func parseMetadata(s string) (map[string]string, error) {
+	s, err := readParameterValue(s)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		var values map[string]interface{}
+		err := json.Unmarshal([]byte(s), &values)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		for key, value := range values {
+			v, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("the value of the metadata key %q must be a string", key)
+			}
+			m[key] = v
+		}
+	} else {
+		for _, kv := range strings.Split(s, ",") {
+			key, value, found := strings.Cut(kv, "=")
+			if !found {
+				return nil, fmt.Errorf("malformed metadata: %q (expected key=value, use JSON if the values contain commas)", kv)
+			}
+			if _, exists := m[key]; exists {
+				return nil, fmt.Errorf("the metadata key %q is specified more than once", key)
+			}
+			m[key] = value
+		}
+	}
+	err = validateMetadata(m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// validateMetadata checks the metadata against the S3 limits, so that the upload does not fail when it is created.
+func validateMetadata(m map[string]string) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	seen := make(map[string]string)
+	size := 0
+	for _, key := range keys {
+		value := m[key]
+		if key == "" {
+			return errors.New("the metadata keys can not be empty")
+		}
+		for _, c := range key {
+			if !isTokenChar(c) {
+				return fmt.Errorf("the metadata key %q contains an invalid character: %q", key, c)
+			}
+		}
+		for _, c := range value {
+			if c < ' ' || c == 0x7f {
+				return fmt.Errorf("the value of the metadata key %q contains a control character", key)
+			}
+		}
+		// S3 stores the keys in lowercase
+		if other, exists := seen[strings.ToLower(key)]; exists {
+			return fmt.Errorf("the metadata keys %q and %q are the same (the keys are case-insensitive)", other, key)
+		}
+		seen[strings.ToLower(key)] = key
+		size += len(key) + len(value)
+		if size > maxMetadataSize {
+			return fmt.Errorf("the metadata key %q exceeds the limit of %d bytes for the total size of the metadata keys and values", key, maxMetadataSize)
+		}
+	}
+	return nil
+}
+
+// isTokenChar returns true if the character can be used in an HTTP header name.
+func isTokenChar(c rune) bool {
+	return c < utf8.RuneSelf && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+}
+
+type tag struct {
+	Key   string
+	Value string
+}
+
+// parseTagging accepts URL query parameters (key1=value1&key2=value2), a JSON object ({"key1": "value1"}), or the JSON format of the aws s3api put-object-tagging command ({"TagSet": [{"Key": "key1", "Value": "value1"}]}), optionally read from a file. It returns the tags encoded as URL query parameters.
+func parseTagging(s string) (string, error) {
+	s, err := readParameterValue(s)
+	if err != nil {
+		return "", err
+	}
+	var tags []tag
+	trimmed := strings.TrimSpace(s)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		tags, err = parseTagJSON(trimmed)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		for _, kv := range strings.Split(s, "&") {
+			if kv == "" {
+				continue
+			}
+			rawKey, rawValue, _ := strings.Cut(kv, "=")
+			key, err := url.QueryUnescape(rawKey)
+			if err != nil {
+				return "", fmt.Errorf("malformed tag key %q: %w", rawKey, err)
+			}
+			value, err := url.QueryUnescape(rawValue)
+			if err != nil {
+				return "", fmt.Errorf("malformed value for the tag key %q: %w", key, err)
+			}
+			tags = append(tags, tag{key, value})
+		}
+	}
+
+	err = validateTags(tags)
+	if err != nil {
+		return "", err
+	}
+	escape := func(s string) string {
+		return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+	}
+	encoded := make([]string, len(tags))
+	for i, t := range tags {
+		encoded[i] = escape(t.Key) + "=" + escape(t.Value)
+	}
+	return strings.Join(encoded, "&"), nil
+}
+
+func parseTagJSON(s string) ([]tag, error) {
+	var tags []tag
+	if strings.HasPrefix(s, "[") {
+		err := json.Unmarshal([]byte(s), &tags)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		return tags, nil
+	}
+	var values map[string]json.RawMessage
+	err := json.Unmarshal([]byte(s), &values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if tagSet, ok := values["TagSet"]; ok && len(values) == 1 {
+		err := json.Unmarshal(tagSet, &tags)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TagSet: %w", err)
+		}
+		return tags, nil
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var value string
+		err := json.Unmarshal(values[key], &value)
+		if err != nil {
+			return nil, fmt.Errorf("the value of the tag key %q must be a string", key)
+		}
+		tags = append(tags, tag{key, value})
+	}
+	return tags, nil
+}
+
+// validateTags checks the tags against the S3 limits, so that the upload does not fail when it is created.
+func validateTags(tags []tag) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("there are %d tags but an object can have at most %d tags", len(tags), maxTags)
+	}
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		if t.Key == "" {
+			return errors.New("the tag keys can not be empty")
+		}
+		if seen[t.Key] {
+			return fmt.Errorf("the tag key %q is specified more than once", t.Key)
+		}
+		seen[t.Key] = true
+		if strings.HasPrefix(strings.ToLower(t.Key), "aws:") {
+			return fmt.Errorf("the tag key %q uses the reserved prefix \"aws:\"", t.Key)
+		}
+		if n := utf8.RuneCountInString(t.Key); n > maxTagKeyLength {
+			return fmt.Errorf("the tag key %q is %d characters long (the limit is %d)", t.Key, n, maxTagKeyLength)
+		}
+		if n := utf8.RuneCountInString(t.Value); n > maxTagValueLength {
+			return fmt.Errorf("the value of the tag key %q is %d characters long (the limit is %d)", t.Key, n, maxTagValueLength)
+		}
+		for _, c := range t.Key + t.Value {
+			if !isTagChar(c) {
+				return fmt.Errorf("the tag key %q contains an invalid character: %q", t.Key, c)
+			}
+		}
+	}
+	return nil
+}
+
+// isTagChar returns true if the character is allowed in tag keys and values (letters, numbers, spaces and + - = . _ : / @).
+func isTagChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsNumber(c) || unicode.IsSpace(c) || strings.ContainsRune("+-=._:/@", c)
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// describeObjectOptions returns a description of the options that are applied to the object, for the information screen.
+func describeObjectOptions(input *s3.CreateMultipartUploadInput) []string {
+	var options []string
+	add := func(name string, value *string) {
+		if aws.ToString(value) != "" {
+			options = append(options, fmt.Sprintf("%s: %s", name, aws.ToString(value)))
+		}
+	}
+	if input.ACL != "" {
+		options = append(options, fmt.Sprintf("ACL: %s", input.ACL))
+	}
+	add("Grant read", input.GrantRead)
+	add("Grant read ACL", input.GrantReadACP)
+	add("Grant write ACL", input.GrantWriteACP)
+	add("Grant full control", input.GrantFullControl)
+	add("Cache-Control", input.CacheControl)
+	add("Content-Disposition", input.ContentDisposition)
+	add("Content-Encoding", input.ContentEncoding)
+	add("Content-Language", input.ContentLanguage)
+	add("Content-Type", input.ContentType)
+	if input.Expires != nil {
+		options = append(options, fmt.Sprintf("Expires: %s", input.Expires.Format("2006-01-02T15:04:05Z07:00")))
+	}
+	add("Website redirect", input.WebsiteRedirectLocation)
+	if len(input.Metadata) > 0 {
+		keys := make([]string, 0, len(input.Metadata))
+		for k := range input.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		options = append(options, fmt.Sprintf("Metadata: %s", strings.Join(keys, ", ")))
+	}
+	add("Tagging", input.Tagging)
+	if input.ServerSideEncryption != "" {
+		options = append(options, fmt.Sprintf("Server-side encryption: %s", input.ServerSideEncryption))
+	}
+	add("SSE-KMS key ID", input.SSEKMSKeyId)
+	if aws.ToString(input.SSEKMSEncryptionContext) != "" {
+		context, _ := base64.StdEncoding.DecodeString(aws.ToString(input.SSEKMSEncryptionContext))
+		options = append(options, fmt.Sprintf("SSE-KMS encryption context: %s", context))
+	}
+	add("SSE-C algorithm", input.SSECustomerAlgorithm)
+	if input.ObjectLockMode != "" {
+		options = append(options, fmt.Sprintf("Object Lock mode: %s", input.ObjectLockMode))
+	}
+	if input.ObjectLockRetainUntilDate != nil {
+		options = append(options, fmt.Sprintf("Object Lock retain until: %s", input.ObjectLockRetainUntilDate.Format("2006-01-02T15:04:05Z07:00")))
+	}
+	if input.ObjectLockLegalHoldStatus != "" {
+		options = append(options, fmt.Sprintf("Object Lock legal hold: %s", input.ObjectLockLegalHoldStatus))
+	}
+	return options
+}
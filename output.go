@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// outputLevel is how much of the diagnostic output is written to stderr. It is lowered with --only-show-errors and --quiet.
+type outputLevel int
+
+const (
+	outputAll      outputLevel = iota
+	outputWarnings             // --only-show-errors: errors and warnings
+	outputErrors               // --quiet: only errors
+)
+
+var verbosity = outputAll
+
+// infoOutput returns where informational messages (e.g. the progress) are written.
+// Errors, interactive prompts and the responses to key presses are always written to os.Stderr.
+func infoOutput() io.Writer {
+	if verbosity != outputAll {
+		return io.Discard
+	}
+	return os.Stderr
+}
+
+// warningOutput returns where warnings are written.
+func warningOutput() io.Writer {
+	if verbosity == outputErrors {
+		return io.Discard
+	}
+	return os.Stderr
+}
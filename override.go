@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// rateOverride is a manual rate change from the keyboard controls. It takes precedence over the schedule and deadline mode until it expires or is cleared.
+type rateOverride struct {
+	rate     int64
+	expires  time.Time // No expiry if zero
+	clearKey rune      // The key that returns to the schedule
+}
+
+func newRateOverride(rate int64, duration time.Duration, clearKey rune) *rateOverride {
+	o := &rateOverride{rate: rate, clearKey: clearKey}
+	if duration > 0 {
+		o.expires = time.Now().Add(duration)
+	}
+	return o
+}
+
+func (o *rateOverride) expired() bool {
+	return !o.expires.IsZero() && !time.Now().Before(o.expires)
+}
+
+// extend pushes the expiry forward. An override without an expiry already lasts until it is cleared, so it is left as it is.
+func (o *rateOverride) extend(d time.Duration) {
+	if o.expires.IsZero() {
+		return
+	}
+	if o.expires.Before(time.Now()) {
+		o.expires = time.Now()
+	}
+	o.expires = o.expires.Add(d)
+}
+
+func (o *rateOverride) String() string {
+	if o.expires.IsZero() {
+		return fmt.Sprintf("%s (until %s is pressed)", formatLimit2(o.rate), keyName(o.clearKey))
+	}
+	return fmt.Sprintf("%s (expires at %s, in %s)", formatLimit2(o.rate), formatTime(o.expires), time.Until(o.expires).Round(time.Second))
+}
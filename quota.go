@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Quota struct {
+	period string // "day", "week" or "month"
+	limit  int64
+}
+
+// The quota usage is stored per period, so that several quotas with the same period share the usage
+type quotaUsage struct {
+	Start time.Time `json:"start"`
+	Bytes int64     `json:"bytes"`
+}
+
+func parseQuota(s string) (Quota, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) != 2 {
+		return Quota{}, fmt.Errorf("invalid quota: %s (expected e.g. \"50GB/day\")", s)
+	}
+	limit, err := parseVolume(parts[0])
+	if err != nil {
+		return Quota{}, fmt.Errorf("invalid quota: %s (%w)", s, err)
+	}
+	if limit <= 0 {
+		return Quota{}, fmt.Errorf("invalid quota: %s (must be greater than zero)", s)
+	}
+	period := strings.ToLower(parts[1])
+	if period != "day" && period != "week" && period != "month" {
+		return Quota{}, fmt.Errorf("invalid quota period: %s (must be day, week or month)", parts[1])
+	}
+	return Quota{period, limit}, nil
+}
+
+func parseQuotas(s string) ([]Quota, error) {
+	var quotas []Quota
+	for _, v := range strings.Split(s, ",") {
+		q, err := parseQuota(v)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range quotas {
+			if other.period == q.period {
+				return nil, fmt.Errorf("more than one quota per %s", q.period)
+			}
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas, nil
+}
+
+// parseVolume parses a data volume in decimal units (like parseRate), optionally ending with "B" (e.g. "50GB").
+func parseVolume(s string) (int64, error) {
+	if len(s) >= 2 && (s[len(s)-1] == 'B' || s[len(s)-1] == 'b') && strings.ContainsRune("kKmMgGtT", rune(s[len(s)-2])) {
+		s = s[0 : len(s)-1]
+	}
+	if len(s) == 0 {
+		return 0, errors.New("empty value")
+	}
+
+	var factor float64 = 1
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		factor = 1e3
+	case 'm', 'M':
+		factor = 1e6
+	case 'g', 'G':
+		factor = 1e9
+	case 't', 'T':
+		factor = 1e12
+	}
+	if factor != 1 {
+		s = s[0 : len(s)-1]
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(f * factor)), nil
+}
+
+// periodStart returns the start of the quota period that t is in. Weeks start on Monday.
+func (q Quota) periodStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch q.period {
+	case "week":
+		return day.AddDate(0, 0, -int(t.Weekday()+6)%7)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return day
+	}
+}
+
+// periodEnd returns the time when the quota resets.
+func (q Quota) periodEnd(t time.Time) time.Time {
+	start := q.periodStart(t)
+	switch q.period {
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+func (q Quota) String() string {
+	return fmt.Sprintf("%s/%s", formatSize(q.limit), q.period)
+}
+
+func defaultConfigDir() (string, error) {
+	if dir, ok := os.LookupEnv("XDG_CONFIG_HOME"); ok && dir != "" {
+		return filepath.Join(dir, "shrimp"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "shrimp"), nil
+}
+
+func readQuotaState(fn string) (map[string]quotaUsage, error) {
+	state := make(map[string]quotaUsage)
+	data, err := os.ReadFile(fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", fn, err)
+	}
+	return state, nil
+}
+
+func writeQuotaState(fn string, state map[string]quotaUsage) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that other shrimp processes never read a partially written file, and a crash can not truncate it
+	tmpFn := fmt.Sprintf("%s.%d.tmp", fn, os.Getpid())
+	err = os.WriteFile(tmpFn, append(data, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFn, fn)
+}
+
+// quotaUsed returns the number of bytes used in the quota's current period.
+func quotaUsed(fn string, q Quota, now time.Time) (int64, error) {
+	state, err := readQuotaState(fn)
+	if err != nil {
+		return 0, err
+	}
+	usage, ok := state[q.period]
+	if !ok || !usage.Start.Equal(q.periodStart(now)) {
+		return 0, nil
+	}
+	return usage.Bytes, nil
+}
+
+// addQuotaUsage records that n bytes were transferred. Other shrimp processes may use the same state file, so it is locked while it is read and rewritten.
+// The usage is added once per period, even if there are several quotas with the same period (e.g. from the schedule file).
+func addQuotaUsage(fn string, quotas []Quota, n int64, now time.Time) error {
+	err := os.MkdirAll(filepath.Dir(fn), 0700)
+	if err != nil {
+		return err
+	}
+	// The state file is replaced when it is written, so a separate file is locked
+	lock, err := lockFile(fn + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	state, err := readQuotaState(fn)
+	if err != nil {
+		return err
+	}
+	added := make(map[string]bool)
+	for _, q := range quotas {
+		if added[q.period] {
+			continue
+		}
+		added[q.period] = true
+		start := q.periodStart(now)
+		usage := state[q.period]
+		if !usage.Start.Equal(start) {
+			usage = quotaUsage{Start: start}
+		}
+		usage.Bytes += n
+		state[q.period] = usage
+	}
+	return writeQuotaState(fn, state)
+}
+
+// checkQuotas returns the first quota that would be exceeded by transferring another n bytes, or nil if all quotas have room for it.
+func checkQuotas(fn string, quotas []Quota, n int64, now time.Time) (*Quota, error) {
+	for i := range quotas {
+		used, err := quotaUsed(fn, quotas[i], now)
+		if err != nil {
+			return nil, err
+		}
+		if used+n > quotas[i].limit {
+			return &quotas[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// mergeQuotas combines the quotas, letting the quotas in overrides replace the quotas with the same period.
+func mergeQuotas(quotas, overrides []Quota) []Quota {
+	result := append([]Quota{}, overrides...)
+	for _, q := range quotas {
+		found := false
+		for _, o := range overrides {
+			if o.period == q.period {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, q)
+		}
+	}
+	return result
+}
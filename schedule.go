@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -14,6 +15,7 @@ import (
 type Schedule struct {
 	defaultRate int64
 	blocks      []ScheduleBlock
+	quotas      []Quota
 }
 
 type ScheduleBlock struct {
@@ -23,6 +25,10 @@ type ScheduleBlock struct {
 	endHour     int
 	endMinute   int
 	rate        int64
+
+	// Blocks from calendar schedules happen at a fixed time instead of every week
+	start time.Time
+	end   time.Time
 }
 
 func parseWeekday(s string) (time.Weekday, error) {
@@ -46,6 +52,14 @@ func parseWeekday(s string) (time.Weekday, error) {
 	}
 }
 
+// loadSchedule reads a schedule file, either in the text format or as an iCalendar file (.ics).
+func loadSchedule(fn string) (*Schedule, error) {
+	if strings.EqualFold(filepath.Ext(fn), ".ics") {
+		return readCalendar(fn, time.Now())
+	}
+	return readSchedule(fn)
+}
+
 func readSchedule(fn string) (*Schedule, error) {
 	file, err := os.Open(fn)
 	if err != nil {
@@ -55,6 +69,7 @@ func readSchedule(fn string) (*Schedule, error) {
 
 	var defaultRate int64
 	var blocks []ScheduleBlock
+	var quotas []Quota
 	scanner := bufio.NewScanner(file)
 	lineNo := 0
 
@@ -76,6 +91,17 @@ func readSchedule(fn string) (*Schedule, error) {
 			continue
 		}
 
+		if strings.HasPrefix(line, "quota:") {
+			parts := strings.SplitN(line, ":", 2)
+			quota, err := parseQuota(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("%w on line %d", err, lineNo)
+			}
+			quotas = append(quotas, quota)
+
+			continue
+		}
+
 		parts := strings.Split(line, ":")
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("invalid format on line %d (expected one colon)", lineNo)
@@ -146,7 +172,7 @@ func readSchedule(fn string) (*Schedule, error) {
 		}
 
 		for _, weekday := range weekdays {
-			blocks = append(blocks, ScheduleBlock{weekday, startHour, startMinute, endHour, endMinute, rate})
+			blocks = append(blocks, ScheduleBlock{weekday: weekday, startHour: startHour, startMinute: startMinute, endHour: endHour, endMinute: endMinute, rate: rate})
 		}
 	}
 
@@ -178,27 +204,51 @@ func readSchedule(fn string) (*Schedule, error) {
 		}
 	}
 
-	return &Schedule{defaultRate, blocks}, nil
+	return &Schedule{defaultRate, blocks, quotas}, nil
 }
 
-func (s Schedule) next() ScheduleBlock {
-	now := time.Now()
+// nextAfter returns the block that is active at the given time, or otherwise the block that starts next.
+// ok is false if there are no more blocks (only possible with calendar schedules).
+func (s Schedule) nextAfter(now time.Time) (ScheduleBlock, bool) {
 	var minBlock *ScheduleBlock
 	var minTimeUntil time.Duration
 	for i := range s.blocks {
 		block := s.blocks[i]
-		start, _ := block.next()
+		start, end := block.nextAfter(now)
+		if !now.Before(end) {
+			// The calendar event has already ended
+			continue
+		}
 		timeUntil := start.Sub(now)
 		if minBlock == nil || timeUntil < 0 || timeUntil < minTimeUntil {
 			minBlock = &block
 			minTimeUntil = timeUntil
 		}
 	}
-	return *minBlock
+	if minBlock == nil {
+		return ScheduleBlock{}, false
+	}
+	return *minBlock, true
 }
 
-func (block ScheduleBlock) next() (time.Time, time.Time) {
-	now := time.Now()
+// rateAt returns the rate that the schedule wants at the given time, and the time when that rate will change.
+func (s Schedule) rateAt(t time.Time) (int64, time.Time) {
+	block, ok := s.nextAfter(t)
+	if !ok {
+		return s.defaultRate, t.AddDate(100, 0, 0)
+	}
+	start, end := block.nextAfter(t)
+	if t.Before(start) {
+		return s.defaultRate, start
+	}
+	return block.rate, end
+}
+
+func (block ScheduleBlock) nextAfter(now time.Time) (time.Time, time.Time) {
+	if !block.start.IsZero() {
+		return block.start, block.end
+	}
+
 	today := now.Weekday()
 	days := int(block.weekday-today+7) % 7
 	t := now.AddDate(0, 0, days)
@@ -210,7 +260,7 @@ func (block ScheduleBlock) next() (time.Time, time.Time) {
 	if end.Before(start) {
 		end = end.Add(time.Hour)
 	}
-	if now.After(end) {
+	if !now.Before(end) {
 		t = t.AddDate(0, 0, 7)
 		start = time.Date(t.Year(), t.Month(), t.Day(), block.startHour, block.startMinute, 0, 0, t.Location())
 		end = time.Date(t.Year(), t.Month(), t.Day(), block.endHour, block.endMinute, 0, 0, t.Location())
@@ -218,9 +268,3 @@ func (block ScheduleBlock) next() (time.Time, time.Time) {
 
 	return start, end
 }
-
-func (block ScheduleBlock) active() bool {
-	nextStart, _ := block.next()
-	now := time.Now()
-	return now.After(nextStart)
-}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Encryption keys (SSE-C and --client-side-key) are 256 bits
+const keyLength = 32
+
+// readSecret reads a secret that should not have to be put on the command line. The value can be:
+//
+//	fileb://path  read from a file
+//	file://path   read from a file (a trailing newline is removed)
+//	env:NAME      read from an environment variable
+//	cmd:COMMAND   the output of a command (e.g. "cmd:pass show backup-key")
+//	SECRET        the secret itself
+func readSecret(s string) ([]byte, error) {
+	if name, found := strings.CutPrefix(s, "env:"); found {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("the environment variable %s is not set", name)
+		}
+		return []byte(value), nil
+	} else if command, found := strings.CutPrefix(s, "cmd:"); found {
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", command)
+		} else {
+			cmd = exec.Command("sh", "-c", command)
+		}
+		// Let the command prompt for a passphrase if needed
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("the command failed: %w", err)
+		}
+		return output, nil
+	}
+	value, err := readParameterValue(s)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// isSecretReference returns true if the value refers to where the secret is read from, rather than being the secret itself.
+func isSecretReference(s string) bool {
+	for _, prefix := range []string{"env:", "cmd:", "file://", "fileb://"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readKey reads a 256-bit key. In addition to the sources supported by readSecret, the key can be given as base64:KEY. Keys that are not 32 bytes long are decoded as base64, so that e.g. an environment variable or a command can provide the key in base64.
+func readKey(s string) ([]byte, error) {
+	if encoded, found := strings.CutPrefix(s, "base64:"); found {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64: %w", err)
+		}
+		if len(key) != keyLength {
+			return nil, fmt.Errorf("the key must be %d bytes (got %d bytes)", keyLength, len(key))
+		}
+		return key, nil
+	}
+
+	data, err := readSecret(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == keyLength {
+		return data, nil
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == keyLength {
+		return trimmed, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(trimmed))
+	if err != nil || len(key) != keyLength {
+		return nil, errors.New("the key must be 32 bytes, either raw or base64-encoded")
+	}
+	return key, nil
+}
+
+// encodeSSECustomerKey returns the values of the SSECustomerKey and SSECustomerKeyMD5 parameters. The SDK sends them as is, so they have to be base64-encoded.
+func encodeSSECustomerKey(key []byte) (string, string) {
+	sum := md5.Sum(key)
+	return base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Splitting large files (--split-large)
+//
+// An S3 object can be at most 5 TiB. With --split-large, the file is uploaded as several objects (<key>.000, <key>.001, ...) that are separate multipart uploads, followed by a manifest (<key>.manifest.json) that lists the chunks in order with their sizes and SHA256 checksums. Every chunk has its checksum and its position in the metadata, so that completed chunks are skipped when the upload is resumed. Use "shrimp join" to download the chunks, verify them and reassemble the file.
+
+// The maximum object size on Amazon S3
+const maxObjectSize = 5 * TiB
+
+// Metadata of the chunks
+const (
+	splitMetadataChunk    = "split-chunk"     // "<index>/<count>"
+	splitMetadataFileSize = "split-file-size" // The size of the whole file
+	splitMetadataFileTime = "split-file-time" // The modification time of the file, so that a chunk of another file with the same size is not mistaken for a completed chunk
+)
+
+type splitPlan struct {
+	key       string
+	fileSize  int64
+	modTime   time.Time
+	chunkSize int64
+	count     int
+}
+
+func newSplitPlan(key string, fileSize int64, modTime time.Time, chunkSize int64) *splitPlan {
+	count := int((fileSize + chunkSize - 1) / chunkSize)
+	if count == 0 {
+		count = 1
+	}
+	return &splitPlan{
+		key:       key,
+		fileSize:  fileSize,
+		modTime:   modTime,
+		chunkSize: chunkSize,
+		count:     count,
+	}
+}
+
+func (p *splitPlan) chunkKey(i int) string {
+	return fmt.Sprintf("%s.%03d", p.key, i)
+}
+
+// chunkRange returns where the chunk starts and ends in the file.
+func (p *splitPlan) chunkRange(i int) (int64, int64) {
+	start := int64(i) * p.chunkSize
+	return start, min(start+p.chunkSize, p.fileSize)
+}
+
+func (p *splitPlan) chunkMetadata(i int) map[string]string {
+	return map[string]string{
+		splitMetadataChunk:    fmt.Sprintf("%d/%d", i, p.count),
+		splitMetadataFileSize: fmt.Sprint(p.fileSize),
+		splitMetadataFileTime: p.modTime.UTC().Format(time.RFC3339),
+	}
+}
+
+// isChunk checks if an existing object is a completed chunk of this upload.
+func (p *splitPlan) isChunk(i int, obj *s3.HeadObjectOutput) bool {
+	start, end := p.chunkRange(i)
+	if aws.ToInt64(obj.ContentLength) != end-start {
+		return false
+	}
+	for k, v := range p.chunkMetadata(i) {
+		if obj.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+type splitManifestChunk struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	ETag   string `json:"etag"`
+}
+
+// splitManifest lists the chunks in the order that they are joined.
+type splitManifest struct {
+	Key       string               `json:"key"`
+	Size      int64                `json:"size"`
+	SHA256    string               `json:"sha256,omitempty"` // The checksum of the whole file, if it was in SHA256SUMS or --compute-checksum was used
+	ChunkSize int64                `json:"chunkSize"`
+	Created   string               `json:"created"`
+	Chunks    []splitManifestChunk `json:"chunks"`
+}
+
+// verify checks that the chunks make up the whole file.
+func (m *splitManifest) verify() error {
+	var offset int64
+	for _, c := range m.Chunks {
+		if c.Offset != offset {
+			return fmt.Errorf("%s starts at offset %d, expected %d", c.Key, c.Offset, offset)
+		}
+		if c.SHA256 == "" {
+			return fmt.Errorf("%s does not have a checksum", c.Key)
+		}
+		offset += c.Size
+	}
+	if offset != m.Size {
+		return fmt.Errorf("the chunks add up to %d bytes, but the file is %d bytes", offset, m.Size)
+	}
+	return nil
+}
+
+// manifest creates the manifest from the completed chunks.
+func (p *splitPlan) manifest(chunks []*s3.HeadObjectOutput, sha256sum string) ([]byte, error) {
+	m := splitManifest{
+		Key:       p.key,
+		Size:      p.fileSize,
+		SHA256:    sha256sum,
+		ChunkSize: p.chunkSize,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Chunks:    make([]splitManifestChunk, len(chunks)),
+	}
+	for i, obj := range chunks {
+		if !p.isChunk(i, obj) {
+			return nil, fmt.Errorf("%s does not match the file", p.chunkKey(i))
+		}
+		start, end := p.chunkRange(i)
+		m.Chunks[i] = splitManifestChunk{
+			Key:    p.chunkKey(i),
+			Offset: start,
+			Size:   end - start,
+			SHA256: obj.Metadata["sha256sum"],
+			ETag:   aws.ToString(obj.ETag),
+		}
+	}
+	err := m.verify()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// joinSplitObject downloads the chunks of a file that was uploaded with --split-large and writes them to output (- for stdout), verifying the size and checksum of every chunk. The key can be the original key or the key of the manifest. The input is used as a template for the GetObject requests (e.g. for SSE-C).
+func joinSplitObject(client *s3.Client, input s3.GetObjectInput, output string) error {
+	manifestKey := aws.ToString(input.Key)
+	if !strings.HasSuffix(manifestKey, manifestSuffix) {
+		manifestKey += manifestSuffix
+	}
+	fmt.Fprintf(infoOutput(), "Reading s3://%s/%s\n", aws.ToString(input.Bucket), manifestKey)
+	manifestInput := input
+	manifestInput.Key = aws.String(manifestKey)
+	obj, err := client.GetObject(context.TODO(), &manifestInput)
+	if err != nil {
+		return err
+	}
+	var manifest splitManifest
+	err = json.NewDecoder(obj.Body).Decode(&manifest)
+	obj.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error parsing the manifest: %w", err)
+	}
+	err = manifest.verify()
+	if err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+	fmt.Fprintf(infoOutput(), "The file is %s in %d chunks.\n", formatFilesize(manifest.Size), len(manifest.Chunks))
+
+	if output == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		err := joinChunks(client, input, &manifest, w)
+		if err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	if strings.HasPrefix(output, "s3://") {
+		return errors.New("the output must be a local file")
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = joinChunks(client, input, &manifest, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	return nil
+}
+
+func joinChunks(client *s3.Client, input s3.GetObjectInput, manifest *splitManifest, w io.Writer) error {
+	fileHash := sha256.New()
+	for _, c := range manifest.Chunks {
+		fmt.Fprintf(infoOutput(), "Downloading %s (%s)... ", c.Key, formatFilesize(c.Size))
+		chunkInput := input
+		chunkInput.Key = aws.String(c.Key)
+		obj, err := client.GetObject(context.TODO(), &chunkInput)
+		if err != nil {
+			fmt.Fprintln(infoOutput())
+			return err
+		}
+		chunkHash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w, chunkHash, fileHash), obj.Body)
+		obj.Body.Close()
+		if err != nil {
+			fmt.Fprintln(infoOutput())
+			return err
+		}
+		if n != c.Size {
+			fmt.Fprintln(infoOutput())
+			return fmt.Errorf("%s is %d bytes, expected %d bytes", c.Key, n, c.Size)
+		}
+		sum := hex.EncodeToString(chunkHash.Sum(nil))
+		if sum != c.SHA256 {
+			fmt.Fprintln(infoOutput())
+			return fmt.Errorf("the checksum of %s does not match (%s, expected %s)", c.Key, sum, c.SHA256)
+		}
+		fmt.Fprintln(infoOutput(), "OK")
+	}
+	if manifest.SHA256 != "" {
+		sum := hex.EncodeToString(fileHash.Sum(nil))
+		if sum != manifest.SHA256 {
+			return fmt.Errorf("the checksum of the file does not match (%s, expected %s)", sum, manifest.SHA256)
+		}
+		fmt.Fprintf(infoOutput(), "The checksum of the file matches: %s\n", sum)
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tar mode (--tar)
+//
+// The directory is walked in lexical order and the tar archive is produced on the fly from the list of entries. Since the size of every header is known in advance, the offset of every file in the archive can be calculated, so any part of the archive can be produced without reading what comes before it (like a file). This makes it possible to compress or encrypt the archive, and to resume an upload.
+//
+// The tar offset that every part reaches is recorded in the upload state, along with a digest of the headers of the files up to that point. When the upload is resumed, the directory is walked again and the archive continues where the last part ended, as long as the files before that point have not changed (the modification times of directories are not compared). Files that come later may have been added, removed or modified, unless the archive is encrypted with --client-side-encrypt: the size of the archive is stored in the encryption header at the beginning of the object, so the archive must have the same size when the upload is resumed.
+
+// The end of a tar archive is marked by two zero blocks
+const tarTrailerSize = 2 * 512
+
+// tarEntry is a file, directory or symlink in the archive. Only what is needed to recreate the header is kept, since a directory may have millions of files.
+type tarEntry struct {
+	path       string // The path on disk
+	name       string // The name in the archive
+	typeflag   byte
+	linkname   string
+	mode       int64
+	uid, gid   int
+	uname      string
+	gname      string
+	modTime    int64 // Unix time, tar headers only have second precision
+	size       int64
+	offset     int64 // Where the header starts in the archive
+	headerSize int64 // The size of the header, including PAX records for long names
+}
+
+func (e *tarEntry) header() *tar.Header {
+	return &tar.Header{
+		Typeflag: e.typeflag,
+		Name:     e.name,
+		Linkname: e.linkname,
+		Size:     e.size,
+		Mode:     e.mode,
+		Uid:      e.uid,
+		Gid:      e.gid,
+		Uname:    e.uname,
+		Gname:    e.gname,
+		ModTime:  time.Unix(e.modTime, 0),
+	}
+}
+
+func (e *tarEntry) headerBytes() ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	// The header is written to buf immediately, the data is added separately
+	err := tw.WriteHeader(e.header())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", e.path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *tarEntry) dataOffset() int64 {
+	return e.offset + e.headerSize
+}
+
+// end returns where the next entry starts. The data is padded to a multiple of 512 bytes.
+func (e *tarEntry) end() int64 {
+	return e.dataOffset() + (e.size+511)/512*512
+}
+
+// tarPart is the tar offset that a part reaches, and a digest of the headers of the entries that start before that offset. It is stored in the upload state.
+type tarPart struct {
+	Offset  int64  `json:"offset"`
+	Entries int    `json:"entries"`
+	Digest  string `json:"digest"`
+}
+
+// tarState is stored in the upload state.
+type tarState struct {
+	Parts []tarPart `json:"parts"`
+}
+
+type tarArchive struct {
+	root    string
+	entries []tarEntry
+	size    int64
+	skipped []string
+
+	mu          sync.Mutex
+	headerIndex int // The entry that is in headerBuf, -1 if none
+	headerBuf   []byte
+	fileIndex   int // The entry that is opened in file, -1 if none
+	file        *os.File
+
+	// The digest of the headers of the first digestEntries entries, which is extended as the upload progresses
+	digest        hash.Hash
+	digestEntries int
+}
+
+// newTarArchive walks the directory and calculates the layout of the archive. The names in the archive start with the name of the directory. Anything that is not a regular file, a directory or a symlink is skipped.
+func newTarArchive(dir string) (*tarArchive, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	a := &tarArchive{
+		root:        root,
+		headerIndex: -1,
+		fileIndex:   -1,
+	}
+	parent := filepath.Dir(root)
+	var offset int64
+	// WalkDir visits the entries of a directory in lexical order, which makes the archive deterministic
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var linkname string
+		switch {
+		case info.Mode().IsRegular(), info.IsDir():
+		case info.Mode()&fs.ModeSymlink != 0:
+			linkname, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		default:
+			a.skipped = append(a.skipped, path)
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, linkname)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		name, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if info.IsDir() {
+			name += "/"
+		}
+		entry := tarEntry{
+			path:     path,
+			name:     name,
+			typeflag: hdr.Typeflag,
+			linkname: hdr.Linkname,
+			mode:     hdr.Mode,
+			uid:      hdr.Uid,
+			gid:      hdr.Gid,
+			uname:    hdr.Uname,
+			gname:    hdr.Gname,
+			modTime:  hdr.ModTime.Unix(),
+			size:     hdr.Size,
+			offset:   offset,
+		}
+		header, err := entry.headerBytes()
+		if err != nil {
+			return err
+		}
+		entry.headerSize = int64(len(header))
+		a.entries = append(a.entries, entry)
+		offset = entry.end()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.size = offset + tarTrailerSize
+	return a, nil
+}
+
+// counts returns the number of files, directories and symlinks in the archive.
+func (a *tarArchive) counts() (int, int, int) {
+	var files, dirs, symlinks int
+	for _, e := range a.entries {
+		switch e.typeflag {
+		case tar.TypeDir:
+			dirs++
+		case tar.TypeSymlink:
+			symlinks++
+		default:
+			files++
+		}
+	}
+	return files, dirs, symlinks
+}
+
+func (a *tarArchive) String() string {
+	files, dirs, symlinks := a.counts()
+	s := fmt.Sprintf("%d files, %d directories", files, dirs)
+	if symlinks > 0 {
+		s += fmt.Sprintf(", %d symlinks", symlinks)
+	}
+	return s
+}
+
+// entryAt returns the index of the entry that contains the offset, or -1 if the offset is in the trailer.
+func (a *tarArchive) entryAt(offset int64) int {
+	if len(a.entries) == 0 || offset >= a.entries[len(a.entries)-1].end() {
+		return -1
+	}
+	return sort.Search(len(a.entries), func(i int) bool {
+		return a.entries[i].offset > offset
+	}) - 1
+}
+
+func (a *tarArchive) ReadAt(p []byte, off int64) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= a.size {
+			return n, io.EOF
+		}
+		i := a.entryAt(pos)
+		if i == -1 {
+			// The trailer and the padding consist of zeros
+			m := int(min(int64(len(p)-n), a.size-pos))
+			clear(p[n : n+m])
+			n += m
+			continue
+		}
+		e := &a.entries[i]
+		rel := pos - e.offset
+		if rel < e.headerSize {
+			if a.headerIndex != i {
+				header, err := e.headerBytes()
+				if err != nil {
+					return n, err
+				}
+				a.headerBuf = header
+				a.headerIndex = i
+			}
+			n += copy(p[n:], a.headerBuf[rel:])
+			continue
+		}
+		rel -= e.headerSize
+		if rel < e.size {
+			m := int(min(int64(len(p)-n), e.size-rel))
+			err := a.readFile(i, p[n:n+m], rel)
+			if err != nil {
+				return n, err
+			}
+			n += m
+			continue
+		}
+		m := int(min(int64(len(p)-n), e.end()-pos))
+		clear(p[n : n+m])
+		n += m
+	}
+	return n, nil
+}
+
+// readFile reads the data of a file. The file is kept open since it is usually read in a sequence of calls.
+func (a *tarArchive) readFile(i int, p []byte, off int64) error {
+	e := &a.entries[i]
+	if a.fileIndex != i {
+		a.closeFile()
+		f, err := os.Open(e.path)
+		if err != nil {
+			return err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if stat.Size() != e.size || stat.ModTime().Unix() != e.modTime {
+			f.Close()
+			return fmt.Errorf("%s has been modified since the directory was scanned", e.path)
+		}
+		a.file = f
+		a.fileIndex = i
+	}
+	n, err := a.file.ReadAt(p, off)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	if err == io.EOF {
+		return fmt.Errorf("%s is smaller than expected (%d bytes), has it been modified?", e.path, e.size)
+	}
+	return err
+}
+
+func (a *tarArchive) closeFile() {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+		a.fileIndex = -1
+	}
+}
+
+func (a *tarArchive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closeFile()
+	return nil
+}
+
+// part returns the information about a part that reaches the offset. The digest covers the headers of the entries that start before the offset, since those must be the same for the upload to be resumed. The modification time of a directory changes when files are added to it, so it is not included unless the part ends in the middle of the header.
+func (a *tarArchive) part(offset int64) (tarPart, error) {
+	entries := sort.Search(len(a.entries), func(i int) bool {
+		return a.entries[i].offset >= offset
+	})
+	// The headers that have been uploaded completely
+	complete := entries
+	if entries > 0 && a.entries[entries-1].dataOffset() > offset {
+		complete--
+	}
+	if a.digest == nil || complete < a.digestEntries {
+		a.digest = sha256.New()
+		a.digestEntries = 0
+	}
+	for ; a.digestEntries < complete; a.digestEntries++ {
+		e := a.entries[a.digestEntries]
+		if e.typeflag == tar.TypeDir {
+			e.modTime = 0
+		}
+		header, err := e.headerBytes()
+		if err != nil {
+			return tarPart{}, err
+		}
+		a.digest.Write(header)
+	}
+	digest := a.digest.Sum(nil)
+	if complete < entries {
+		header, err := a.entries[complete].headerBytes()
+		if err != nil {
+			return tarPart{}, err
+		}
+		sum := sha256.Sum256(append(digest, header...))
+		digest = sum[:]
+	}
+	return tarPart{
+		Offset:  offset,
+		Entries: entries,
+		Digest:  hex.EncodeToString(digest),
+	}, nil
+}
+
+// resumeAt checks that the entries before the offset that was reached by a part have not changed since the part was uploaded.
+func (a *tarArchive) resumeAt(p tarPart) error {
+	current, err := a.part(p.Offset)
+	if err != nil {
+		return err
+	}
+	if current.Entries != p.Entries {
+		return fmt.Errorf("%d entries were archived before, but now there are %d entries before the same position", p.Entries, current.Entries)
+	}
+	if current.Digest != p.Digest {
+		return fmt.Errorf("some of the first %d entries have been added, removed or modified", p.Entries)
+	}
+	return nil
+}
+
+type tarManifestEntry struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Size       int64  `json:"size"`
+	Mode       string `json:"mode"`
+	ModTime    string `json:"mtime"`
+	Linkname   string `json:"linkname,omitempty"`
+	DataOffset int64  `json:"offset"` // Where the data starts in the (uncompressed) archive
+}
+
+// tarManifest lists the entries of the archive. With an uncompressed and unencrypted archive, a single file can be extracted with a ranged GET request using the offset and size.
+type tarManifest struct {
+	Archive     string             `json:"archive"`
+	Directory   string             `json:"directory"`
+	Size        int64              `json:"size"`
+	Compression string             `json:"compression,omitempty"`
+	Encrypted   bool               `json:"encrypted,omitempty"`
+	Created     string             `json:"created"`
+	Entries     []tarManifestEntry `json:"entries"`
+}
+
+func (a *tarArchive) manifest(bucket, key, compression string, encrypted bool) ([]byte, error) {
+	m := tarManifest{
+		Archive:     fmt.Sprintf("s3://%s/%s", bucket, key),
+		Directory:   a.root,
+		Size:        a.size,
+		Compression: compression,
+		Encrypted:   encrypted,
+		Created:     time.Now().UTC().Format(time.RFC3339),
+		Entries:     make([]tarManifestEntry, len(a.entries)),
+	}
+	for i, e := range a.entries {
+		t := "file"
+		switch e.typeflag {
+		case tar.TypeDir:
+			t = "directory"
+		case tar.TypeSymlink:
+			t = "symlink"
+		}
+		m.Entries[i] = tarManifestEntry{
+			Name:       e.name,
+			Type:       t,
+			Size:       e.size,
+			Mode:       fmt.Sprintf("%04o", e.mode&07777),
+			ModTime:    time.Unix(e.modTime, 0).UTC().Format(time.RFC3339),
+			Linkname:   e.linkname,
+			DataOffset: e.dataOffset(),
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -42,3 +42,18 @@ func RestoreTerminal(state *State) error {
 	fd := os.Stdin.Fd()
 	return termios.Tcsetattr(fd, termios.TCSANOW, state.stdin)
 }
+
+// Size returns the width and height of the terminal that f is connected to.
+func Size(f *os.File) (int, int, error) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(ws.Col), int(ws.Row), nil
+}
+
+// IsTerminal returns true if f is connected to a terminal.
+func IsTerminal(f *os.File) bool {
+	var state unix.Termios
+	return termios.Tcgetattr(f.Fd(), &state) == nil
+}
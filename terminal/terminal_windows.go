@@ -66,3 +66,19 @@ func RestoreTerminal(oldState *State) error {
 
 	return nil
 }
+
+// Size returns the width and height of the console that f is connected to.
+func Size(f *os.File) (int, int, error) {
+	var info windows.ConsoleScreenBufferInfo
+	err := windows.GetConsoleScreenBufferInfo(windows.Handle(f.Fd()), &info)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(info.Window.Right-info.Window.Left) + 1, int(info.Window.Bottom-info.Window.Top) + 1, nil
+}
+
+// IsTerminal returns true if f is connected to a console.
+func IsTerminal(f *os.File) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(f.Fd()), &mode) == nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stefansundin/shrimp/flowrate"
+	"github.com/stefansundin/shrimp/terminal"
+)
+
+type partState int
+
+const (
+	partPending partState = iota
+	partInFlight
+	partDone
+	partFailed
+)
+
+// Number of lines kept from the diagnostic output. They are printed when the full-screen mode ends so that they are not lost.
+const tuiMaxMessages = 1000
+
+// Number of rate samples kept for the graph (one per second)
+const tuiMaxHistory = 600
+
+var escapeSequenceRegexp = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// tuiInfo is the information about the upload that is shown in the full-screen mode.
+type tuiInfo struct {
+	title          string
+	partNumber     int32
+	status         flowrate.Status
+	rate           string
+	limit          int64
+	limitSource    string
+	nextTransition string
+	remaining      string
+	notice         string
+}
+
+// tui is the full-screen mode (--tui). It uses the alternate screen of the terminal and redirects os.Stderr so that the diagnostic output is shown in a section of the screen instead of scrolling.
+type tui struct {
+	mu       sync.Mutex
+	out      *os.File // The real stderr
+	pipe     *os.File
+	done     chan struct{}
+	parts    []partState
+	history  []int64
+	messages []string
+	partial  string // The line that is currently being written
+	info     tuiInfo
+	keys     *keymap
+	stopped  bool
+}
+
+func startTUI(numParts, partsDone int, keys *keymap) (*tui, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	t := &tui{
+		out:   os.Stderr,
+		pipe:  w,
+		done:  make(chan struct{}),
+		parts: make([]partState, numParts),
+		keys:  keys,
+	}
+	for i := 0; i < partsDone && i < numParts; i++ {
+		t.parts[i] = partDone
+	}
+	os.Stderr = w
+	fmt.Fprint(t.out, "\033[?1049h\033[?25l")
+	go t.readMessages(r)
+	return t, nil
+}
+
+// stop leaves the full-screen mode and prints the diagnostic output that was captured.
+func (t *tui) stop() {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.stopped = true
+	os.Stderr = t.out
+	t.mu.Unlock()
+
+	t.pipe.Close()
+	<-t.done
+	fmt.Fprint(t.out, "\033]0;\007\033[?25h\033[?1049l")
+	for _, msg := range t.messages {
+		fmt.Fprintln(t.out, msg)
+	}
+	if t.partial != "" {
+		fmt.Fprint(t.out, t.partial)
+	}
+}
+
+func (t *tui) readMessages(r *os.File) {
+	defer close(t.done)
+	defer r.Close()
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		switch c {
+		case '\n':
+			t.messages = append(t.messages, escapeSequenceRegexp.ReplaceAllString(t.partial, ""))
+			if len(t.messages) > tuiMaxMessages {
+				t.messages = t.messages[1:]
+			}
+			t.partial = ""
+		case '\r':
+			t.partial = ""
+		case '\b':
+			if len(t.partial) > 0 {
+				t.partial = t.partial[:len(t.partial)-1]
+			}
+		default:
+			t.partial += string(c)
+		}
+		// Redraw once the output has been consumed, so that prompts (e.g. for the MFA code) are visible right away
+		if br.Buffered() == 0 && !t.stopped {
+			t.render()
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *tui) setPart(partNumber int32, state partState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// With --follow, the number of parts grows with the file
+	for int(partNumber) > len(t.parts) {
+		t.parts = append(t.parts, partPending)
+	}
+	if i := int(partNumber) - 1; i >= 0 && i < len(t.parts) {
+		t.parts[i] = state
+	}
+}
+
+// update is called once per second while a part is being uploaded.
+func (t *tui) update(info tuiInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info = info
+	t.history = append(t.history, info.status.CurRate)
+	if len(t.history) > tuiMaxHistory {
+		t.history = t.history[1:]
+	}
+	if !t.stopped {
+		t.render()
+	}
+}
+
+func (t *tui) render() {
+	width, height, err := terminal.Size(t.out)
+	if err != nil || width < 20 || height < 10 {
+		width, height = 80, 24
+	}
+	info := t.info
+	s := info.status
+	var lines []string
+	add := func(format string, a ...interface{}) {
+		line := fmt.Sprintf(format, a...)
+		if len([]rune(line)) > width {
+			line = string([]rune(line)[:width])
+		}
+		lines = append(lines, line)
+	}
+
+	add("\033[1m%s\033[0m", info.title)
+	add("")
+	add("Part %d of %d: %s, %s remaining.", info.partNumber, len(t.parts), s.Progress, s.TimeRem.Round(time.Second))
+	barWidth := width - 2
+	filled := int(float64(barWidth) * float64(s.TotalProgress) / 100)
+	if filled > barWidth {
+		filled = barWidth
+	} else if filled < 0 {
+		filled = 0
+	}
+	add("[%s%s]", strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled))
+	add("Total: %s (%s of %s), %s.", s.TotalProgress, formatSize(s.TotalBytes), formatSize(s.TotalBytes+s.TotalBytesRem), info.remaining)
+	add("Rate: %s. Limit: %s (%s).", info.rate, formatLimit2(info.limit), info.limitSource)
+	if info.nextTransition != "" {
+		add("Next schedule transition: %s", info.nextTransition)
+	}
+	if info.notice != "" {
+		add("\033[1m%s\033[0m", info.notice)
+	}
+	add("")
+
+	// Rate graph
+	graph := t.history
+	if len(graph) > width {
+		graph = graph[len(graph)-width:]
+	}
+	var peak int64
+	for _, v := range graph {
+		peak = max(peak, v)
+	}
+	add("Rate history (last %s, peak: %s/s):", niceDuration(time.Duration(len(graph))*time.Second), formatSize(peak))
+	add("%s", sparkline(graph, peak))
+	add("")
+
+	// Part map, one cell per part (or per group of parts if there are too many to fit)
+	cells := 4 * width
+	perCell := int(math.Ceil(float64(len(t.parts)) / float64(cells)))
+	if perCell == 0 {
+		perCell = 1
+	}
+	if perCell == 1 {
+		add("Parts (# done, > in progress, . pending, ! failed):")
+	} else {
+		add("Parts (%d per cell, # done, > in progress, . pending, ! failed):", perCell)
+	}
+	var grid strings.Builder
+	for i := 0; i < len(t.parts); i += perCell {
+		end := i + perCell
+		if end > len(t.parts) {
+			end = len(t.parts)
+		}
+		grid.WriteString(partCell(t.parts[i:end]))
+		if grid.Len() == width {
+			lines = append(lines, grid.String())
+			grid.Reset()
+		}
+	}
+	if grid.Len() > 0 {
+		lines = append(lines, grid.String())
+	}
+	add("")
+
+	// Key map at the bottom (in two columns, or a summary if the terminal is small), recent messages fill the space in between
+	var keys []string
+	help := t.keys.helpLines()
+	half := (len(help) + 1) / 2
+	for i := 0; i < half; i++ {
+		key := fmt.Sprintf("%-*s", width/2, help[i])
+		if i+half < len(help) {
+			key += help[i+half]
+		}
+		keys = append(keys, key)
+	}
+	space := height - len(lines) - len(keys) - 2
+	if space < 4 {
+		keys = []string{t.keys.summary()}
+		space = height - len(lines) - len(keys) - 2
+	}
+	if space > 0 {
+		add("Recent messages:")
+		messages := t.messages
+		if t.partial != "" {
+			messages = append(messages[:len(messages):len(messages)], escapeSequenceRegexp.ReplaceAllString(t.partial, ""))
+		}
+		if len(messages) > space-1 {
+			messages = messages[len(messages)-(space-1):]
+		}
+		for _, msg := range messages {
+			add("%s", msg)
+		}
+		for i := len(messages); i < space-1; i++ {
+			add("")
+		}
+		add("")
+	}
+	for _, k := range keys {
+		add("%s", k)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\033]0;shrimp: %s (part %d/%d)\007", s.TotalProgress, info.partNumber, len(t.parts))
+	b.WriteString("\033[H")
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString("\033[K")
+	}
+	b.WriteString("\033[J")
+	t.out.WriteString(b.String())
+}
+
+// partCell returns the character for a group of parts. Failures are the most important to show, followed by parts in progress.
+func partCell(group []partState) string {
+	state := partDone
+	for _, p := range group {
+		if p == partFailed {
+			return "!"
+		} else if p == partInFlight {
+			state = partInFlight
+		} else if p == partPending && state == partDone {
+			state = partPending
+		}
+	}
+	switch state {
+	case partInFlight:
+		return ">"
+	case partPending:
+		return "."
+	}
+	return "#"
+}
+
+func sparkline(values []int64, peak int64) string {
+	ticks := []rune("▁▂▃▄▅▆▇█")
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if peak > 0 {
+			i = int(float64(v) / float64(peak) * float64(len(ticks)-1))
+		}
+		b.WriteRune(ticks[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// uploadState is information about a multipart upload that S3 does not keep for us but that is needed to resume it, e.g. the parameters of the client-side encryption (the metadata of an upload in progress can not be retrieved) where the compressed parts start in the file, which block device is being uploaded, and how far the tar archive has come. It is stored in ~/.config/shrimp/uploads/ and removed when the upload is completed.
+type uploadState struct {
+	Bucket      string            `json:"bucket"`
+	Key         string            `json:"key"`
+	UploadId    string            `json:"uploadId"`
+	File        string            `json:"file"`
+	Device      *deviceInfo       `json:"device,omitempty"`
+	Encryption  *encryptionParams `json:"encryption,omitempty"`
+	Compression *compressionState `json:"compression,omitempty"`
+	Tar         *tarState         `json:"tar,omitempty"`
+}
+
+func uploadStateFile(bucket, key, uploadId string) (string, error) {
+	configDir, err := defaultConfigDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(bucket + "/" + key + "/" + uploadId))
+	return filepath.Join(configDir, "uploads", hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// readUploadState returns nil if there is no state for the upload.
+func readUploadState(bucket, key, uploadId string) (*uploadState, error) {
+	fn, err := uploadStateFile(bucket, key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", fn, err)
+	}
+	return &state, nil
+}
+
+func writeUploadState(state *uploadState) error {
+	fn, err := uploadStateFile(state.Bucket, state.Key, state.UploadId)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(fn), 0700)
+	if err != nil {
+		return err
+	}
+	tmpFn := fmt.Sprintf("%s.%d.tmp", fn, os.Getpid())
+	err = os.WriteFile(tmpFn, append(data, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFn, fn)
+}
+
+func removeUploadState(bucket, key, uploadId string) error {
+	fn, err := uploadStateFile(bucket, key, uploadId)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
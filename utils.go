@@ -14,12 +14,15 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	smithyhttp "github.com/aws/smithy-go/transport/http"
+	flag "github.com/stefansundin/go-zflag"
 )
 
 const kiB = 1024
@@ -27,6 +30,9 @@ const MiB = 1024 * kiB
 const GiB = 1024 * MiB
 const TiB = 1024 * GiB
 
+// The manifests of --tar and --split-large are stored next to the object, with this suffix added to the key
+const manifestSuffix = ".manifest.json"
+
 func min(a, b int64) int64 {
 	if a < b {
 		return a
@@ -97,8 +103,54 @@ func parseRate(s string) (int64, error) {
 	return int64(math.Round(f * float64(factor))), nil
 }
 
+// parseRateExpression parses a rate that is typed interactively. In addition to what parseRate accepts, the rate can be relative to the current rate (e.g. "+5m", "-500k" or "50%").
+func parseRateExpression(s string, current int64) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("no rate entered")
+	}
+	var newRate int64
+	if s[0] == '+' || s[0] == '-' || s[len(s)-1] == '%' {
+		if current == 0 {
+			return 0, errors.New("can not adjust an unlimited rate")
+		}
+		if s[len(s)-1] == '%' {
+			f, err := strconv.ParseFloat(s[:len(s)-1], 64)
+			if err != nil {
+				return 0, err
+			}
+			newRate = int64(math.Round(float64(current) * f / 100))
+		} else {
+			if len(s) == 1 {
+				return 0, fmt.Errorf("invalid rate: %s", s)
+			}
+			delta, err := parseRate(s[1:])
+			if err != nil {
+				return 0, err
+			}
+			if s[0] == '-' {
+				delta = -delta
+			}
+			newRate = current + delta
+		}
+	} else {
+		var err error
+		newRate, err = parseRate(s)
+		if err != nil {
+			return 0, err
+		}
+		if newRate == 0 {
+			return 0, nil
+		}
+	}
+	if newRate < 1e3 {
+		newRate = 1e3
+	}
+	return newRate, nil
+}
+
 func parseFilesize(s string) (int64, error) {
-	factor := 1
+	var factor int64 = 1
 	suffix := s[len(s)-1]
 	if suffix == 'k' || suffix == 'K' {
 		factor = kiB
@@ -106,6 +158,8 @@ func parseFilesize(s string) (int64, error) {
 		factor = MiB
 	} else if suffix == 'g' || suffix == 'G' {
 		factor = GiB
+	} else if suffix == 't' || suffix == 'T' {
+		factor = TiB
 	}
 	if factor != 1 {
 		s = s[0 : len(s)-1]
@@ -153,6 +207,9 @@ func parseTimestamp(s string) (*time.Time, error) {
 	// - YYYY-MM-DDThh:mm:ss.sssTZD (with offset), for example, 2014-10-01T12:30:00.000-08:00
 	// - YYYY-MM-DD, for example, 2014-10-01
 	// - Unix time in seconds, for example, 1412195400. This is sometimes referred to as Unix Epoch time and represents the number of seconds since midnight, January 1, 1970 UTC.
+	// shrimp additionally accepts timestamps without a time zone, which are interpreted as local time:
+	// - YYYY-MM-DDThh:mm:ss, for example, 2014-10-01T20:30:00
+	// - YYYY-MM-DDThh:mm, for example, 2014-10-01T20:30
 	var err error
 	var t time.Time
 	if isNumeric(s) {
@@ -165,26 +222,104 @@ func parseTimestamp(s string) (*time.Time, error) {
 		t, err = time.Parse(time.RFC3339, s)
 		if err != nil {
 			t, err = time.Parse("2006-01-02", s)
-			if err != nil {
-				return nil, err
-			}
+		}
+		if err != nil {
+			t, err = time.ParseInLocation("2006-01-02T15:04:05", s, time.Local)
+		}
+		if err != nil {
+			t, err = time.ParseInLocation("2006-01-02T15:04", s, time.Local)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
 	return &t, nil
 }
 
-func parseMetadata(s string) (map[string]string, error) {
-	m := make(map[string]string)
-	for _, kv := range strings.Split(s, ",") {
-		e := strings.SplitN(kv, "=", 2)
-		if len(e) < 2 {
-			return nil, errors.New("Malformed metadata.")
+// parseTimeSpec parses a timestamp parameter, a time of day (the next occurrence is used, e.g. "22:00") or a duration from now (e.g. "2h30m").
+func parseTimeSpec(s string, now time.Time) (*time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		t := now.Add(d)
+		return &t, nil
+	}
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if tod, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			t := time.Date(now.Year(), now.Month(), now.Day(), tod.Hour(), tod.Minute(), tod.Second(), 0, time.Local)
+			if !t.After(now) {
+				t = t.AddDate(0, 0, 1)
+			}
+			return &t, nil
 		}
-		key := e[0]
-		value := e[1]
-		m[key] = value
 	}
-	return m, nil
+	return parseTimestamp(s)
+}
+
+// Flags that limit when the upload runs. They are left out of the command that resumes the upload, since they would stop the upload right away or wait again.
+var timeLimitFlags = []string{"start-at", "stop-at", "run-for"}
+
+// resumeArgs returns the arguments of the command that resumes the upload. The time limits are removed, and the ones that were set in the config file or the environment (sources, see applyConfig) are turned off. The secrets are masked since the command is printed, unless they refer to where the secret is read from (e.g. env:NAME).
+func resumeArgs(args []string, sources map[string]string) []string {
+	var result []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if i == 0 {
+			result = append(result, arg)
+			for _, name := range timeLimitFlags {
+				if source, ok := sources[name]; ok && source != "command line" {
+					result = append(result, "--"+name+"="+flag.Lookup(name).DefValue)
+				}
+			}
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			result = append(result, arg)
+			continue
+		}
+		if arg == "--" {
+			result = append(result, args[i:]...)
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if slices.Contains(timeLimitFlags, name) {
+			if !hasValue {
+				i++
+			}
+			continue
+		}
+		if configSecretFlags[name] {
+			if !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if !isSecretReference(value) {
+				value = "********"
+			}
+			result = append(result, "--"+name+"="+value)
+			continue
+		}
+		result = append(result, arg)
+	}
+	return result
+}
+
+// shellQuoteArgs formats the arguments so that they can be copied and pasted into a shell.
+func shellQuoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		safe := len(arg) > 0
+		for _, c := range arg {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && !strings.ContainsRune("_-./:=@%+,", c) {
+				safe = false
+				break
+			}
+		}
+		if safe {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
 }
 
 func formatSize(size int64) string {
@@ -227,6 +362,21 @@ func formatLimit(rate int64, parenthesis bool) string {
 	return fmt.Sprintf(", limit: %s/s", formatSize(rate))
 }
 
+func formatAdaptiveLimit(rate int64, parenthesis bool) string {
+	if parenthesis {
+		return fmt.Sprintf(" (adaptive limit: %s)", formatLimit2(rate))
+	}
+	return fmt.Sprintf(", adaptive limit: %s", formatLimit2(rate))
+}
+
+// minLimit returns the lowest of two limits, where 0 means unlimited
+func minLimit(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
 func formatLimit2(rate int64) string {
 	if rate == 0 {
 		return "unlimited"
@@ -234,6 +384,16 @@ func formatLimit2(rate int64) string {
 	return fmt.Sprintf("%s/s", formatSize(rate))
 }
 
+func formatTime(t time.Time) string {
+	now := time.Now()
+	if t.Year() == now.Year() && t.YearDay() == now.YearDay() {
+		return t.Format("15:04")
+	} else if t.Sub(now) < 6*24*time.Hour {
+		return t.Format("Mon 15:04")
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
 func lookupChecksum(sumsFn string, fn string) (string, error) {
 	entryPath, err := filepath.Abs(fn)
 	if err != nil {
@@ -276,8 +436,12 @@ func computeSha256Sum(fn string) (string, error) {
 		return "", err
 	}
 	defer file.Close()
+	return computeSha256SumReader(file)
+}
+
+func computeSha256SumReader(r io.Reader) (string, error) {
 	hash := sha256.New()
-	_, err = io.Copy(hash, file)
+	_, err := io.Copy(hash, r)
 	if err != nil {
 		return "", err
 	}
@@ -285,6 +449,15 @@ func computeSha256Sum(fn string) (string, error) {
 	return sum, nil
 }
 
+func knownCannedACLs() []string {
+	values := s3Types.ObjectCannedACLPrivate.Values()
+	result := make([]string, len(values))
+	for i, v := range values {
+		result[i] = string(v)
+	}
+	return result
+}
+
 func knownStorageClasses() []string {
 	values := s3Types.StorageClassStandard.Values()
 	result := make([]string, len(values))
@@ -311,6 +484,12 @@ func isSmithyErrorCode(err error, code int) bool {
 	return false
 }
 
+// isAPIErrorCode returns true if the service returned one of the error codes (e.g. "NoSuchUpload").
+func isAPIErrorCode(err error, codes ...string) bool {
+	var ae smithy.APIError
+	return errors.As(err, &ae) && slices.Contains(codes, ae.ErrorCode())
+}
+
 func generateOTP(secretBytes []byte, counter uint64, hashAlg func() hash.Hash, digits int) (string, error) {
 	mac := hmac.New(hashAlg, secretBytes)
 	buf := make([]byte, 8)